@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/AgoraIO-Community/go-tokenbuilder/rtctokenbuilder"
+	"github.com/gin-gonic/gin"
+)
+
+// Authorizer decides whether a uid may receive a token for a channel, e.g. by
+// checking room membership. rtm tokens aren't channel scoped and are checked
+// with an empty channel and RoleSubscriber.
+type Authorizer interface {
+	Authorize(ctx context.Context, channel, uid string, role rtctokenbuilder.Role) error
+}
+
+// noopAuthorizer allows every request
+type noopAuthorizer struct{}
+
+func (noopAuthorizer) Authorize(ctx context.Context, channel, uid string, role rtctokenbuilder.Role) error {
+	return nil
+}
+
+// authorizer is consulted before every token is issued
+var authorizer Authorizer = noopAuthorizer{}
+
+// authorizeToken aborts with a 403 and returns false when the authorizer rejects req
+func authorizeToken(c *gin.Context, req TokenRequest) bool {
+	if err := authorizeRequest(c.Request.Context(), req); err != nil {
+		c.Error(err)
+		abortWithError(c, 403, "Not authorized: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// authorizeRequest checks every identity req issues tokens for
+func authorizeRequest(ctx context.Context, req TokenRequest) error {
+	if err := authorizer.Authorize(ctx, req.ChannelName, req.UidStr, req.Role); err != nil {
+		return err
+	}
+	if req.UserAccount != "" {
+		return authorizer.Authorize(ctx, req.ChannelName, req.UserAccount, req.Role)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AgoraIO-Community/go-tokenbuilder/rtctokenbuilder"
+	"github.com/gin-gonic/gin"
+)
+
+// authorizerFunc adapts a function to the Authorizer interface
+type authorizerFunc func(ctx context.Context, channel, uid string, role rtctokenbuilder.Role) error
+
+func (f authorizerFunc) Authorize(ctx context.Context, channel, uid string, role rtctokenbuilder.Role) error {
+	return f(ctx, channel, uid, role)
+}
+
+func TestAuthorizerRejectionIsForbidden(t *testing.T) {
+	type check struct {
+		channel string
+		uid     string
+		role    rtctokenbuilder.Role
+	}
+	var checks []check
+	useAuthorizer(t, authorizerFunc(func(ctx context.Context, channel, uid string, role rtctokenbuilder.Role) error {
+		checks = append(checks, check{channel, uid, role})
+		return errors.New("not a member")
+	}))
+
+	tests := []struct {
+		path      string
+		handler   gin.HandlerFunc
+		target    string
+		wantCheck check
+	}{
+		{"/rtc/:channelName/:role/:tokentype/:uid/", getRtcToken, "/rtc/room/publisher/uid/42/", check{"room", "42", rtctokenbuilder.RolePublisher}},
+		{"/rtm/:uid/", getRtmToken, "/rtm/42/", check{"", "42", rtctokenbuilder.RoleSubscriber}},
+	}
+	for _, test := range tests {
+		checks = nil
+		router := newTestRouter("GET", test.path, test.handler)
+		var response struct {
+			Error *apiError `json:"error"`
+		}
+		if code := serve(t, router, "GET", test.target, "", &response); code != 403 || response.Error == nil || response.Error.Code != 403 {
+			t.Errorf("%s with a rejecting authorizer responded %d: %+v, want a 403", test.target, code, response.Error)
+		}
+		if len(checks) != 1 || checks[0] != test.wantCheck {
+			t.Errorf("%s asked the authorizer %+v, want %+v", test.target, checks, test.wantCheck)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AgoraIO-Community/go-tokenbuilder/rtctokenbuilder"
+	"github.com/digitallysavvy/agora-token-server/config"
+	"github.com/digitallysavvy/agora-token-server/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// channelTokenWorkers bounds how many channel tokens are generated concurrently
+const channelTokenWorkers = 8
+
+// channelsRequest is the body accepted by the getForChannels endpoint, which accepts
+// at most 100 channels per request. uid is required unless TRUST_JWT_UID replaces it
+// with the sub claim.
+type channelsRequest struct {
+	Channels             []string `json:"channels" binding:"required,min=1,max=100"`
+	Tokentype            string   `json:"tokentype" binding:"required"`
+	Uid                  string   `json:"uid"`
+	UserAccount          string   `json:"userAccount"`
+	Role                 string   `json:"role"`
+	Expiry               uint32   `json:"expiry"`
+	CanPublishDataStream *bool    `json:"canPublishDataStream"`
+}
+
+// getTokensForChannels issues one rtc token per requested channel for the same uid and
+// role. Problems with a single channel are reported next to the tokens that did succeed;
+// only request level problems fail the whole request.
+func getTokensForChannels(c *gin.Context) {
+	logger.Debugf("rtc tokens for channels")
+	var req channelsRequest
+	if err := bindJSON(c, &req); err != nil {
+		c.Error(err)
+		abortWithBindError(c, "Error Generating RTC tokens: invalid request body", err)
+		return
+	}
+
+	specs, known := rtcTokenGenerators[req.Tokentype]
+	uidStr, uidErr := resolveUid(c, req.Uid)
+	if uidErr == nil && uidStr == "" {
+		uidErr = errUidRequired
+	}
+	var userAccount string
+	if uidErr == nil && !known {
+		uidErr = fmt.Errorf("failed to generate RTC token for Unknown Tokentype: %s", req.Tokentype)
+	}
+	if uidErr == nil && requiresUserAccount(req.Tokentype) {
+		if userAccount, uidErr = resolveUid(c, req.UserAccount); uidErr == nil && userAccount == "" {
+			uidErr = fmt.Errorf("tokentype %s requires a userAccount", req.Tokentype)
+		}
+	}
+	if uidErr != nil {
+		c.Error(uidErr)
+		abortWithError(c, 400, "Error Generating RTC tokens: "+uidErr.Error())
+		return
+	}
+
+	if req.Expiry == 0 {
+		req.Expiry = defaultExpireTime
+	}
+	expireTimestamp, expiryErr := expireTimestampIn(req.Expiry)
+	if expiryErr != nil {
+		c.Error(expiryErr)
+		abortWithError(c, 400, "Error Generating RTC tokens: "+expiryErr.Error())
+		return
+	}
+	baseReq := TokenRequest{
+		Credentials:          c.MustGet(credentialsKey).(config.Credentials),
+		UidStr:               uidStr,
+		UserAccount:          userAccount,
+		Role:                 rtctokenbuilder.RoleSubscriber,
+		ExpireTimestamp:      expireTimestamp,
+		CanPublishDataStream: req.CanPublishDataStream == nil || *req.CanPublishDataStream,
+	}
+	if req.Role == "publisher" {
+		baseReq.Role = rtctokenbuilder.RolePublisher
+	}
+
+	// each token field of the tokentype is returned as a map of channel to token, e.g.
+	// rtcToken as rtcTokens
+	tokens := make(map[string]map[string]string, len(specs))
+	for _, spec := range specs {
+		tokens[spec.Field+"s"] = make(map[string]string)
+	}
+	generated := 0
+	channelErrors := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, channelTokenWorkers)
+
+	seen := make(map[string]bool)
+	for _, channelName := range req.Channels {
+		// duplicate channels in the request are only generated once
+		if seen[channelName] {
+			continue
+		}
+		seen[channelName] = true
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(channelName string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			tokenReq := baseReq
+			tokenReq.ChannelName = channelName
+			rtcTokens, err := generateChannelTokens(c, req.Tokentype, tokenReq)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				channelErrors[channelName] = err.Error()
+				return
+			}
+			for field, rtcToken := range rtcTokens {
+				tokens[field+"s"][channelName] = rtcToken
+			}
+			generated++
+		}(channelName)
+	}
+	wg.Wait()
+
+	logger.Infof("RTC Tokens generated for %d of %d channels", generated, generated+len(channelErrors))
+	response := gin.H{
+		"errors": channelErrors,
+	}
+	for field, channelTokens := range tokens {
+		response[field] = channelTokens
+	}
+	c.JSON(200, response)
+}
+
+// generateChannelTokens validates and authorizes a single channel before generating its tokens
+func generateChannelTokens(c *gin.Context, tokentype string, req TokenRequest) (map[string]string, error) {
+	if err := ValidateChannelName(req.ChannelName); err != nil {
+		return nil, err
+	}
+	if err := authorizeRequest(c.Request.Context(), req); err != nil {
+		return nil, fmt.Errorf("Not authorized: %s", err)
+	}
+	return generateRtcTokens(tokentype, req)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/AgoraIO-Community/go-tokenbuilder/accesstoken"
+	"github.com/gin-gonic/gin"
+)
+
+type channelsResponse struct {
+	RtcTokens map[string]string `json:"rtcTokens"`
+	Errors    map[string]string `json:"errors"`
+	Error     *apiError         `json:"error"`
+}
+
+func TestGetTokensForChannels(t *testing.T) {
+	router := newTestRouter("POST", "/token/getForChannels", getTokensForChannels)
+
+	var response channelsResponse
+	code := serve(t, router, "POST", "/token/getForChannels",
+		`{"channels":["roomA","roomB"],"tokentype":"uid","uid":"42","role":"publisher"}`, &response)
+	if code != 200 {
+		t.Fatalf("getForChannels responded %d: %+v", code, response.Error)
+	}
+	if len(response.RtcTokens) != 2 || len(response.Errors) != 0 {
+		t.Fatalf("getForChannels = %+v, want tokens for roomA and roomB", response)
+	}
+	for _, channelName := range []string{"roomA", "roomB"} {
+		token := decodeToken(t, response.RtcTokens[channelName])
+		if _, _, err := verifyRtcToken(testCredentials, response.RtcTokens[channelName], channelName, "42"); err != nil {
+			t.Errorf("token for %s doesn't verify: %s", channelName, err)
+		}
+		if _, canPublish := token.Message[accesstoken.KPublishAudioStream]; !canPublish {
+			t.Errorf("token for %s is missing the publisher privileges", channelName)
+		}
+	}
+}
+
+func TestGetTokensForChannelsReportsChannelErrors(t *testing.T) {
+	useAuthorizer(t, testAuthorizer{deny: map[string]bool{"closed": true}})
+	router := newTestRouter("POST", "/token/getForChannels", getTokensForChannels)
+
+	var response channelsResponse
+	code := serve(t, router, "POST", "/token/getForChannels",
+		`{"channels":["open","closed","bad/name"],"tokentype":"uid","uid":"42"}`, &response)
+	if code != 200 {
+		t.Fatalf("getForChannels responded %d: %+v", code, response.Error)
+	}
+	if _, issued := response.RtcTokens["open"]; !issued || len(response.RtcTokens) != 1 {
+		t.Errorf("getForChannels tokens = %v, want only open", response.RtcTokens)
+	}
+	if len(response.Errors) != 2 || response.Errors["closed"] == "" || response.Errors["bad/name"] == "" {
+		t.Errorf("getForChannels errors = %v, want closed and bad/name", response.Errors)
+	}
+}
+
+func TestGetTokensForChannelsGeneratesDuplicatesOnce(t *testing.T) {
+	calls := make(chan string, 10)
+	useAuthorizer(t, testAuthorizer{calls: calls})
+	router := newTestRouter("POST", "/token/getForChannels", getTokensForChannels)
+
+	var response channelsResponse
+	code := serve(t, router, "POST", "/token/getForChannels",
+		`{"channels":["roomA","roomA","roomB","roomA"],"tokentype":"uid","uid":"42"}`, &response)
+	close(calls)
+	if code != 200 {
+		t.Fatalf("getForChannels responded %d: %+v", code, response.Error)
+	}
+	if len(response.RtcTokens) != 2 || len(response.Errors) != 0 {
+		t.Errorf("getForChannels = %+v, want one token each for roomA and roomB", response)
+	}
+	generated := make(map[string]int)
+	for call := range calls {
+		generated[call]++
+	}
+	if generated["roomA/42"] != 1 || generated["roomB/42"] != 1 || len(generated) != 2 {
+		t.Errorf("getForChannels authorized %v, want roomA and roomB once each", generated)
+	}
+}
+
+func TestGetTokensForChannelsRejectsOverflowingExpiry(t *testing.T) {
+	router := newTestRouter("POST", "/token/getForChannels", getTokensForChannels)
+
+	var response channelsResponse
+	code := serve(t, router, "POST", "/token/getForChannels",
+		`{"channels":["roomA"],"tokentype":"uid","uid":"42","expiry":`+strconv.FormatUint(math.MaxUint32, 10)+`}`, &response)
+	if code != 400 || response.Error == nil || response.RtcTokens != nil {
+		t.Errorf("getForChannels with an overflowing expiry responded %d: %+v, want a 400", code, response)
+	}
+}
+
+func TestGetTokensForChannelsUid(t *testing.T) {
+	var response channelsResponse
+	body := `{"channels":["room"],"tokentype":"uid"}`
+	router := newTestRouter("POST", "/token/getForChannels", getTokensForChannels)
+	if code := serve(t, router, "POST", "/token/getForChannels", body, &response); code != 400 || response.Error == nil {
+		t.Errorf("getForChannels without a uid responded %d, want a 400", code)
+	}
+
+	// with TRUST_JWT_UID the uid comes from the sub claim, so the body can leave it out
+	trustJWTUID = true
+	defer func() { trustJWTUID = false }()
+	router = newTestRouter("POST", "/token/getForChannels", func(c *gin.Context) {
+		c.Set(userIDKey, "7")
+	}, getTokensForChannels)
+	response = channelsResponse{}
+	if code := serve(t, router, "POST", "/token/getForChannels", body, &response); code != 200 {
+		t.Fatalf("getForChannels without a uid but with a sub claim responded %d: %+v", code, response.Error)
+	}
+	if _, _, err := verifyRtcToken(testCredentials, response.RtcTokens["room"], "room", "7"); err != nil {
+		t.Errorf("token isn't issued for the sub claim: %s", err)
+	}
+}
@@ -0,0 +1,283 @@
+// Package config loads the token server's settings from the environment.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/digitallysavvy/agora-token-server/logger"
+)
+
+// DefaultTokenExpireSeconds is the token lifetime used when TOKEN_EXPIRE_SECONDS is unset or invalid
+const DefaultTokenExpireSeconds uint32 = 3600
+
+// DefaultGuestMaxExpireSeconds is the guest token lifetime cap used when GUEST_MAX_EXPIRE_SECONDS is unset or invalid
+const DefaultGuestMaxExpireSeconds uint32 = 300
+
+// DefaultEncryptionCacheSize is how many channels the random encryption scheme keeps keys for
+// when ENCRYPTION_CACHE_SIZE is unset or invalid
+const DefaultEncryptionCacheSize = 10000
+
+// DefaultServiceName is the service.name traces are exported under when OTEL_SERVICE_NAME is unset
+const DefaultServiceName = "agora-token-server"
+
+// DefaultMaxBodyBytes is the request body cap used when MAX_BODY_BYTES is unset or invalid
+const DefaultMaxBodyBytes int64 = 1 << 20
+
+// Channel encryption schemes accepted by ENCRYPTION_SCHEME
+const (
+	// EncryptionRandom keeps a random key per channel in this instance's memory
+	EncryptionRandom = "random"
+	// EncryptionDerived derives each channel's key from ENCRYPTION_KEY
+	EncryptionDerived = "derived"
+)
+
+// Credentials are the Agora app credentials tokens are signed with
+type Credentials struct {
+	AppID          string `json:"appId"`
+	AppCertificate string `json:"appCertificate"`
+}
+
+// Config holds every setting the server reads from the environment
+type Config struct {
+	// Default is the APP_ID/APP_CERTIFICATE pair, nil when only tenants are configured
+	Default *Credentials
+	// Tenants maps a tenant identifier to that tenant's app credentials
+	Tenants map[string]Credentials
+	// TokenExpireSeconds is the token lifetime used when a request doesn't set one
+	TokenExpireSeconds uint32
+	// GuestMaxExpireSeconds caps the lifetime of guest tokens
+	GuestMaxExpireSeconds uint32
+	// MaxBodyBytes caps the size of request bodies the server will read
+	MaxBodyBytes int64
+	// JWTPublicKey is a PEM encoded key bearer tokens are verified against
+	JWTPublicKey string
+	// JWTJWKSURL is a JWKS endpoint bearer token keys are fetched from
+	JWTJWKSURL string
+	// JWTAudience is the audience bearer tokens must be issued for, unchecked when empty
+	JWTAudience string
+	// TrustJWTUID issues tokens for the bearer token's sub claim instead of the client's uid
+	TrustJWTUID bool
+	// StrictJSON rejects request bodies containing fields the endpoint doesn't define
+	StrictJSON bool
+	// TokenAuditLog logs the identity and a fingerprint of every issued token
+	TokenAuditLog bool
+	// TrustedProxies are the proxy IPs/CIDRs whose forwarding headers set the client IP
+	TrustedProxies []string
+	// EncryptionScheme is how channel encryption secrets are generated
+	EncryptionScheme string
+	// EncryptionKey is the secret derived channel encryption keys are computed from
+	EncryptionKey string
+	// EncryptionCacheSize caps how many channels the random encryption scheme issues keys for
+	EncryptionCacheSize int
+	// LogLevel is the minimum level messages are logged at
+	LogLevel logger.Level
+	// OTLPEndpoint is the OTLP/HTTP collector traces are exported to, tracing is off when empty
+	OTLPEndpoint string
+	// ServiceName is the service.name exported traces are tagged with
+	ServiceName string
+}
+
+// JWTEnabled reports whether bearer token authentication is configured
+func (cfg *Config) JWTEnabled() bool {
+	return cfg.JWTPublicKey != "" || cfg.JWTJWKSURL != ""
+}
+
+// Load reads the configuration from the environment once. Missing credentials are
+// an error; invalid optional values are logged and replaced by their defaults.
+func Load() (*Config, error) {
+	cfg := &Config{
+		TokenExpireSeconds:    DefaultTokenExpireSeconds,
+		GuestMaxExpireSeconds: DefaultGuestMaxExpireSeconds,
+		MaxBodyBytes:          DefaultMaxBodyBytes,
+		EncryptionScheme:      EncryptionRandom,
+		EncryptionCacheSize:   DefaultEncryptionCacheSize,
+		LogLevel:              logger.LevelInfo,
+		ServiceName:           DefaultServiceName,
+	}
+
+	if levelEnv, levelExists := os.LookupEnv("LOG_LEVEL"); levelExists {
+		level, parseErr := logger.ParseLevel(levelEnv)
+		if parseErr != nil {
+			logger.Warnf("invalid LOG_LEVEL: %s, falling back to %s", levelEnv, cfg.LogLevel)
+		} else {
+			cfg.LogLevel = level
+		}
+	}
+
+	appIDEnv, appIDExists, err := lookupSecret("APP_ID")
+	if err != nil {
+		return nil, err
+	}
+	appCertEnv, appCertExists, err := lookupSecret("APP_CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+
+	if appIDExists != appCertExists {
+		return nil, errors.New("ENV not properly configured, check appID and appCertificate")
+	}
+	if appIDExists {
+		cfg.Default = &Credentials{AppID: appIDEnv, AppCertificate: appCertEnv}
+	}
+
+	tenants, err := loadTenants()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Tenants = tenants
+
+	if cfg.Default == nil && len(cfg.Tenants) == 0 {
+		return nil, errors.New("ENV not properly configured, check appID and appCertificate")
+	}
+
+	if expireEnv, expireExists := os.LookupEnv("TOKEN_EXPIRE_SECONDS"); expireExists {
+		expire64, parseErr := strconv.ParseUint(expireEnv, 10, 32)
+		if parseErr != nil || expire64 == 0 {
+			logger.Warnf("invalid TOKEN_EXPIRE_SECONDS: %s, falling back to %d seconds", expireEnv, cfg.TokenExpireSeconds)
+		} else {
+			cfg.TokenExpireSeconds = uint32(expire64)
+		}
+	}
+
+	if guestExpireEnv, guestExpireExists := os.LookupEnv("GUEST_MAX_EXPIRE_SECONDS"); guestExpireExists {
+		guestExpire64, parseErr := strconv.ParseUint(guestExpireEnv, 10, 32)
+		if parseErr != nil || guestExpire64 == 0 {
+			logger.Warnf("invalid GUEST_MAX_EXPIRE_SECONDS: %s, falling back to %d seconds", guestExpireEnv, cfg.GuestMaxExpireSeconds)
+		} else {
+			cfg.GuestMaxExpireSeconds = uint32(guestExpire64)
+		}
+	}
+
+	if maxBodyEnv, maxBodyExists := os.LookupEnv("MAX_BODY_BYTES"); maxBodyExists {
+		maxBody64, parseErr := strconv.ParseInt(maxBodyEnv, 10, 64)
+		if parseErr != nil || maxBody64 <= 0 {
+			logger.Warnf("invalid MAX_BODY_BYTES: %s, falling back to %d bytes", maxBodyEnv, cfg.MaxBodyBytes)
+		} else {
+			cfg.MaxBodyBytes = maxBody64
+		}
+	}
+
+	if cfg.JWTPublicKey, _, err = lookupSecret("JWT_PUBLIC_KEY"); err != nil {
+		return nil, err
+	}
+	cfg.JWTJWKSURL = os.Getenv("JWT_JWKS_URL")
+	cfg.JWTAudience = os.Getenv("JWT_AUDIENCE")
+
+	if cfg.JWTPublicKey != "" && cfg.JWTJWKSURL != "" {
+		return nil, errors.New("ENV not properly configured, set only one of JWT_PUBLIC_KEY and JWT_JWKS_URL")
+	}
+
+	if cfg.TrustJWTUID, err = lookupBool("TRUST_JWT_UID"); err != nil {
+		return nil, err
+	}
+	if cfg.TrustJWTUID && !cfg.JWTEnabled() {
+		return nil, errors.New("ENV not properly configured, TRUST_JWT_UID requires JWT_PUBLIC_KEY or JWT_JWKS_URL")
+	}
+
+	if cfg.StrictJSON, err = lookupBool("STRICT_JSON"); err != nil {
+		return nil, err
+	}
+
+	if cfg.TokenAuditLog, err = lookupBool("TOKEN_AUDIT_LOG"); err != nil {
+		return nil, err
+	}
+
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+		}
+	}
+
+	if scheme, schemeExists := os.LookupEnv("ENCRYPTION_SCHEME"); schemeExists {
+		if scheme != EncryptionRandom && scheme != EncryptionDerived {
+			return nil, fmt.Errorf("ENV not properly configured, ENCRYPTION_SCHEME must be %s or %s", EncryptionRandom, EncryptionDerived)
+		}
+		cfg.EncryptionScheme = scheme
+	}
+	if cfg.EncryptionKey, _, err = lookupSecret("ENCRYPTION_KEY"); err != nil {
+		return nil, err
+	}
+	if cfg.EncryptionScheme == EncryptionDerived && len(cfg.EncryptionKey) < 32 {
+		return nil, errors.New("ENV not properly configured, ENCRYPTION_SCHEME=derived requires an ENCRYPTION_KEY of at least 32 characters")
+	}
+	if cfg.EncryptionScheme == EncryptionRandom {
+		logger.Warnf("ENCRYPTION_SCHEME=%s keeps channel encryption keys in this instance's memory; they're lost on restart and not shared with other instances, set ENCRYPTION_SCHEME=%s when running more than one", EncryptionRandom, EncryptionDerived)
+	}
+	if cacheSizeEnv, cacheSizeExists := os.LookupEnv("ENCRYPTION_CACHE_SIZE"); cacheSizeExists {
+		cacheSize, parseErr := strconv.Atoi(cacheSizeEnv)
+		if parseErr != nil || cacheSize <= 0 {
+			logger.Warnf("invalid ENCRYPTION_CACHE_SIZE: %s, falling back to %d channels", cacheSizeEnv, cfg.EncryptionCacheSize)
+		} else {
+			cfg.EncryptionCacheSize = cacheSize
+		}
+	}
+
+	cfg.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if cfg.OTLPEndpoint != "" {
+		endpoint, parseErr := url.Parse(cfg.OTLPEndpoint)
+		if parseErr != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("ENV not properly configured, OTEL_EXPORTER_OTLP_ENDPOINT must be an http(s) URL: %s", cfg.OTLPEndpoint)
+		}
+	}
+	if serviceName := os.Getenv("OTEL_SERVICE_NAME"); serviceName != "" {
+		cfg.ServiceName = serviceName
+	}
+
+	return cfg, nil
+}
+
+// lookupBool parses an optional boolean env var, defaulting to false when unset
+func lookupBool(name string) (bool, error) {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return false, nil
+	}
+	parsed, parseErr := strconv.ParseBool(value)
+	if parseErr != nil {
+		return false, fmt.Errorf("failed to parse %s: %s, causing error: %s", name, value, parseErr)
+	}
+	return parsed, nil
+}
+
+// lookupSecret reads a secret from the file named by NAME_FILE when set, trimming
+// surrounding whitespace, and otherwise from the NAME env var itself. This lets
+// Docker and Kubernetes secrets be mounted as files instead of passed inline.
+func lookupSecret(name string) (value string, exists bool, err error) {
+	if path, pathExists := os.LookupEnv(name + "_FILE"); pathExists {
+		secret, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return "", false, fmt.Errorf("failed to read %s_FILE: %s, causing error: %s", name, path, readErr)
+		}
+		return strings.TrimSpace(string(secret)), true, nil
+	}
+	value, exists = os.LookupEnv(name)
+	return value, exists, nil
+}
+
+// loadTenants reads the tenant credential map as JSON from APP_CREDENTIALS (or the
+// file named by APP_CREDENTIALS_FILE), e.g.
+// {"tenantA": {"appId": "...", "appCertificate": "..."}}
+func loadTenants() (map[string]Credentials, error) {
+	raw, rawExists, err := lookupSecret("APP_CREDENTIALS")
+	if err != nil || !rawExists {
+		return nil, err
+	}
+
+	var tenants map[string]Credentials
+	if err := json.Unmarshal([]byte(raw), &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant credentials, causing error: %s", err)
+	}
+	for tenant, creds := range tenants {
+		if tenant == "" || creds.AppID == "" || creds.AppCertificate == "" {
+			return nil, fmt.Errorf("tenant credentials for %q must set appId and appCertificate", tenant)
+		}
+	}
+	return tenants, nil
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// configEnv lists every variable Load reads, so each test starts from a clean environment
+var configEnv = []string{
+	"LOG_LEVEL", "APP_ID", "APP_ID_FILE", "APP_CERTIFICATE", "APP_CERTIFICATE_FILE",
+	"APP_CREDENTIALS", "APP_CREDENTIALS_FILE", "TOKEN_EXPIRE_SECONDS", "GUEST_MAX_EXPIRE_SECONDS",
+	"MAX_BODY_BYTES", "JWT_PUBLIC_KEY", "JWT_PUBLIC_KEY_FILE", "JWT_JWKS_URL", "JWT_AUDIENCE",
+	"TRUST_JWT_UID", "STRICT_JSON", "TOKEN_AUDIT_LOG", "TRUSTED_PROXIES", "ENCRYPTION_SCHEME",
+	"ENCRYPTION_KEY", "ENCRYPTION_KEY_FILE", "ENCRYPTION_CACHE_SIZE", "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_SERVICE_NAME",
+}
+
+const (
+	testAppID          = "970ca35de60c44645bbae8a215061b33"
+	testAppCertificate = "5cfd2fd1755d40ecb72977518be15d3b"
+)
+
+// useEnv replaces the environment Load reads with env for the rest of the test
+func useEnv(t *testing.T, env map[string]string) {
+	previous := make(map[string]*string)
+	for _, name := range configEnv {
+		if value, exists := os.LookupEnv(name); exists {
+			previous[name] = &value
+		} else {
+			previous[name] = nil
+		}
+		os.Unsetenv(name)
+	}
+	t.Cleanup(func() {
+		for name, value := range previous {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	})
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+}
+
+// writeFile writes contents to a file in the test's temp dir and returns its path
+func writeFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	useEnv(t, map[string]string{
+		"APP_ID":               "inline",
+		"APP_ID_FILE":          writeFile(t, testAppID+"\n"),
+		"APP_CERTIFICATE_FILE": writeFile(t, "  "+testAppCertificate+"  "),
+	})
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if cfg.Default == nil || cfg.Default.AppID != testAppID || cfg.Default.AppCertificate != testAppCertificate {
+		t.Errorf("Load read credentials %+v, want the trimmed file contents over the inline APP_ID", cfg.Default)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	useEnv(t, map[string]string{
+		"APP_ID":               testAppID,
+		"APP_CERTIFICATE":      testAppCertificate,
+		"APP_CERTIFICATE_FILE": missing,
+	})
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "APP_CERTIFICATE_FILE") {
+		t.Errorf("Load with an unreadable APP_CERTIFICATE_FILE = %v, want an error naming it", err)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		credentials string
+		wantErr     string
+	}{
+		{`{"tenantA": {"appId": "` + testAppID + `", "appCertificate": "` + testAppCertificate + `"}}`, ""},
+		{`{"tenantA": {"appId": "` + testAppID + `"}}`, "must set appId and appCertificate"},
+		{`{"": {"appId": "` + testAppID + `", "appCertificate": "` + testAppCertificate + `"}}`, "must set appId and appCertificate"},
+		{`["tenantA"]`, "failed to parse tenant credentials"},
+		{`{}`, "ENV not properly configured"},
+	}
+	for _, test := range tests {
+		useEnv(t, map[string]string{"APP_CREDENTIALS": test.credentials})
+		cfg, err := Load()
+		if test.wantErr == "" {
+			if err != nil || cfg.Tenants["tenantA"].AppID != testAppID || cfg.Default != nil {
+				t.Errorf("Load with APP_CREDENTIALS=%s = %+v, %v, want only tenantA", test.credentials, cfg, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("Load with APP_CREDENTIALS=%s = %v, want an error containing %q", test.credentials, err, test.wantErr)
+		}
+	}
+}
+
+func TestLoadJWTSettings(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		wantErr string
+	}{
+		{map[string]string{"TRUST_JWT_UID": "true"}, "TRUST_JWT_UID requires"},
+		{map[string]string{"TRUST_JWT_UID": "yes please"}, "failed to parse TRUST_JWT_UID"},
+		{map[string]string{"JWT_PUBLIC_KEY": "key", "JWT_JWKS_URL": "https://example.com/jwks"}, "set only one of"},
+		{map[string]string{"JWT_PUBLIC_KEY_FILE": writeFile(t, "key"), "JWT_JWKS_URL": "https://example.com/jwks"}, "set only one of"},
+		{map[string]string{"JWT_PUBLIC_KEY": "key", "TRUST_JWT_UID": "true"}, ""},
+	}
+	for _, test := range tests {
+		test.env["APP_ID"], test.env["APP_CERTIFICATE"] = testAppID, testAppCertificate
+		useEnv(t, test.env)
+		cfg, err := Load()
+		if test.wantErr == "" {
+			if err != nil || !cfg.TrustJWTUID || !cfg.JWTEnabled() {
+				t.Errorf("Load with %v = %+v, %v, want JWT auth trusting the sub claim", test.env, cfg, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("Load with %v = %v, want an error containing %q", test.env, err, test.wantErr)
+		}
+	}
+}
+
+func TestLoadTokenExpireSeconds(t *testing.T) {
+	tests := map[string]uint32{
+		"600":        600,
+		"0":          DefaultTokenExpireSeconds,
+		"-1":         DefaultTokenExpireSeconds,
+		"an hour":    DefaultTokenExpireSeconds,
+		"4294967296": DefaultTokenExpireSeconds,
+	}
+	for value, want := range tests {
+		useEnv(t, map[string]string{"APP_ID": testAppID, "APP_CERTIFICATE": testAppCertificate, "TOKEN_EXPIRE_SECONDS": value})
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("Load with TOKEN_EXPIRE_SECONDS=%s failed: %s", value, err)
+		}
+		if cfg.TokenExpireSeconds != want {
+			t.Errorf("Load with TOKEN_EXPIRE_SECONDS=%s = %d, want %d", value, cfg.TokenExpireSeconds, want)
+		}
+	}
+}
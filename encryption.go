@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/digitallysavvy/agora-token-server/config"
+	"github.com/digitallysavvy/agora-token-server/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// encryptionModeAES256GCM2 is Agora's AES_256_GCM2 media stream encryption mode,
+// the same value a recording's RecordingConfig.DecryptionMode expects
+const encryptionModeAES256GCM2 = 8
+
+// encryptionScheme is how channel secrets and salts are produced: config.EncryptionRandom
+// keeps a random key per channel in memory, config.EncryptionDerived derives one from
+// encryptionKey so every instance agrees without shared state
+var encryptionScheme string
+
+// encryptionKey is the server secret derived channel keys are computed from
+var encryptionKey string
+
+// encryptionCacheSize caps how many channels the random scheme keeps keys for
+var encryptionCacheSize int
+
+// channelEncryption is the media stream encryption a channel's clients and recorder share
+type channelEncryption struct {
+	Mode     int    `json:"mode"`
+	ModeName string `json:"modeName"`
+	// Secret is a 64 character hex string for the SDK's encryptionKey
+	Secret string `json:"secret"`
+	// Salt is 32 bytes, base64 encoded, for the SDK's encryptionKdfSalt
+	Salt string `json:"salt"`
+}
+
+// randomEncryption holds the random scheme's channel keys. Keys are never evicted:
+// a channel given a new key mid-call would leave its new joiners unable to decrypt
+// the media, so once encryptionCacheSize channels are held new channels are refused.
+var randomEncryption = struct {
+	sync.Mutex
+	channels map[string]channelEncryption
+}{channels: make(map[string]channelEncryption)}
+
+// errEncryptionCacheFull is returned for new channels once the random scheme holds
+// encryptionCacheSize channel keys
+var errEncryptionCacheFull = errors.New("channel encryption is unavailable for new channels, the encryption key cache is full")
+
+// requestedEncryption returns the channel's encryption when the request passes
+// encryption=true, and nil otherwise
+func requestedEncryption(c *gin.Context, creds config.Credentials, channelName string) (*channelEncryption, error) {
+	encryptionParam := c.DefaultQuery("encryption", "false")
+	wantsEncryption, err := strconv.ParseBool(encryptionParam)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption: %s, causing error: %s", encryptionParam, err)
+	}
+	if !wantsEncryption {
+		return nil, nil
+	}
+	encryption, err := encryptionForChannel(creds.AppID, channelName)
+	return &encryption, err
+}
+
+// encryptionForChannel returns the same secret and salt for every request for a channel.
+// Keys are scoped by appID so tenants sharing a channel name don't share a key.
+func encryptionForChannel(appID, channelName string) (channelEncryption, error) {
+	if encryptionScheme == config.EncryptionDerived {
+		mac := hmac.New(sha256.New, []byte(encryptionKey))
+		mac.Write([]byte("secret:" + appID + ":" + channelName))
+		secret := mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write([]byte("salt:" + appID + ":" + channelName))
+		salt := mac.Sum(nil)
+		return newChannelEncryption(secret, salt), nil
+	}
+
+	randomEncryption.Lock()
+	defer randomEncryption.Unlock()
+	cacheKey := appID + ":" + channelName
+	if encryption, exists := randomEncryption.channels[cacheKey]; exists {
+		return encryption, nil
+	}
+	if len(randomEncryption.channels) >= encryptionCacheSize {
+		logger.Errorf("%s, at %d channels", errEncryptionCacheFull, encryptionCacheSize)
+		return channelEncryption{}, errEncryptionCacheFull
+	}
+
+	secret := make([]byte, 32)
+	salt := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return channelEncryption{}, fmt.Errorf("failed to generate encryption secret: %s", err)
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return channelEncryption{}, fmt.Errorf("failed to generate encryption salt: %s", err)
+	}
+	encryption := newChannelEncryption(secret, salt)
+	randomEncryption.channels[cacheKey] = encryption
+	return encryption, nil
+}
+
+func newChannelEncryption(secret, salt []byte) channelEncryption {
+	return channelEncryption{
+		Mode:     encryptionModeAES256GCM2,
+		ModeName: "AES_256_GCM2",
+		Secret:   hex.EncodeToString(secret),
+		Salt:     base64.StdEncoding.EncodeToString(salt),
+	}
+}
+
+// withEncryption adds the channel's encryption to a token response when it was requested
+func withEncryption(response gin.H, encryption *channelEncryption) gin.H {
+	if encryption != nil {
+		response["encryption"] = encryption
+	}
+	return response
+}
+
+// encryptionErrorStatus is the response status for a requestedEncryption error
+func encryptionErrorStatus(err error) int {
+	if errors.Is(err, errEncryptionCacheFull) {
+		return 503
+	}
+	return 400
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/digitallysavvy/agora-token-server/config"
+)
+
+// useEncryption switches the encryption scheme for the rest of the test, starting
+// from an empty random key cache
+func useEncryption(t *testing.T, scheme, key string, cacheSize int) {
+	previousScheme, previousKey, previousSize := encryptionScheme, encryptionKey, encryptionCacheSize
+	encryptionScheme, encryptionKey, encryptionCacheSize = scheme, key, cacheSize
+	randomEncryption.Lock()
+	randomEncryption.channels = make(map[string]channelEncryption)
+	randomEncryption.Unlock()
+	t.Cleanup(func() {
+		encryptionScheme, encryptionKey, encryptionCacheSize = previousScheme, previousKey, previousSize
+	})
+}
+
+func mustEncryption(t *testing.T, appID, channelName string) channelEncryption {
+	t.Helper()
+	encryption, err := encryptionForChannel(appID, channelName)
+	if err != nil {
+		t.Fatalf("encryptionForChannel(%s, %s) failed: %s", appID, channelName, err)
+	}
+	secret, secretErr := hex.DecodeString(encryption.Secret)
+	salt, saltErr := base64.StdEncoding.DecodeString(encryption.Salt)
+	if secretErr != nil || saltErr != nil || len(secret) != 32 || len(salt) != 32 || encryption.Mode != encryptionModeAES256GCM2 {
+		t.Fatalf("encryptionForChannel(%s, %s) = %+v, want a 32 byte hex secret and base64 salt", appID, channelName, encryption)
+	}
+	return encryption
+}
+
+func TestDerivedEncryption(t *testing.T) {
+	useEncryption(t, config.EncryptionDerived, "0123456789abcdef0123456789abcdef", 1)
+
+	room := mustEncryption(t, testCredentials.AppID, "room")
+	if again := mustEncryption(t, testCredentials.AppID, "room"); again != room {
+		t.Errorf("derived encryption for the same channel changed: %+v then %+v", room, again)
+	}
+	// derived keys aren't cached, so the cache size doesn't limit them
+	if other := mustEncryption(t, testCredentials.AppID, "other"); other.Secret == room.Secret || other.Salt == room.Salt {
+		t.Errorf("derived encryption for another channel reused room's key")
+	}
+	if otherApp := mustEncryption(t, "0123456789abcdef0123456789abcdef", "room"); otherApp.Secret == room.Secret || otherApp.Salt == room.Salt {
+		t.Errorf("derived encryption for another appID reused its key")
+	}
+
+	encryptionKey = "fedcba9876543210fedcba9876543210"
+	if rotated := mustEncryption(t, testCredentials.AppID, "room"); rotated.Secret == room.Secret {
+		t.Errorf("derived encryption didn't change with ENCRYPTION_KEY")
+	}
+}
+
+func TestRandomEncryption(t *testing.T) {
+	useEncryption(t, config.EncryptionRandom, "", 2)
+
+	room := mustEncryption(t, testCredentials.AppID, "room")
+	if again := mustEncryption(t, testCredentials.AppID, "room"); again != room {
+		t.Errorf("random encryption for the same channel changed: %+v then %+v", room, again)
+	}
+	if otherApp := mustEncryption(t, "0123456789abcdef0123456789abcdef", "room"); otherApp.Secret == room.Secret {
+		t.Errorf("random encryption for another appID reused its key")
+	}
+
+	// the cache is full, so new channels are refused but known ones keep their key
+	if _, err := encryptionForChannel(testCredentials.AppID, "new"); err != errEncryptionCacheFull {
+		t.Errorf("encryptionForChannel with a full cache = %v, want errEncryptionCacheFull", err)
+	}
+	if again := mustEncryption(t, testCredentials.AppID, "room"); again != room {
+		t.Errorf("random encryption for room changed once the cache filled up")
+	}
+}
+
+func TestRtcTokenEncryptionCacheFull(t *testing.T) {
+	useEncryption(t, config.EncryptionRandom, "", 1)
+	router := newTestRouter("GET", "/rtc/:channelName/:role/:tokentype/:uid/", getRtcToken)
+
+	var response struct {
+		RtcToken   string             `json:"rtcToken"`
+		Encryption *channelEncryption `json:"encryption"`
+		Error      *apiError          `json:"error"`
+	}
+	if code := serve(t, router, "GET", "/rtc/room/subscriber/uid/42/?encryption=true", "", &response); code != 200 || response.Encryption == nil {
+		t.Fatalf("rtc token with encryption responded %d: %+v", code, response)
+	}
+	response.Encryption = nil
+	if code := serve(t, router, "GET", "/rtc/other/subscriber/uid/42/?encryption=true", "", &response); code != 503 || response.Error == nil {
+		t.Errorf("rtc token with encryption and a full cache responded %d: %+v, want a 503", code, response)
+	}
+}
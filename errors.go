@@ -0,0 +1,27 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// apiError is the envelope every error response is wrapped in:
+// {"error": {"code": 400, "message": "..."}}
+type apiError struct {
+	// Code is the response's HTTP status
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Details lists the invalid fields of a request body, when that's what failed
+	Details []fieldError `json:"details,omitempty"`
+}
+
+// abortWithError stops the handler chain and responds with the error envelope
+func abortWithError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": apiError{Code: status, Message: message},
+	})
+}
+
+// abortWithBindError responds 400 with the fields bindJSON rejected
+func abortWithBindError(c *gin.Context, message string, err error) {
+	c.AbortWithStatusJSON(400, gin.H{
+		"error": apiError{Code: 400, Message: message, Details: bindErrorDetails(err)},
+	})
+}
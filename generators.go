@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AgoraIO-Community/go-tokenbuilder/accesstoken"
+	"github.com/AgoraIO-Community/go-tokenbuilder/rtctokenbuilder"
+	"github.com/AgoraIO-Community/go-tokenbuilder/rtmtokenbuilder"
+	"github.com/digitallysavvy/agora-token-server/config"
+	"github.com/digitallysavvy/agora-token-server/logger"
+)
+
+// TokenRequest holds the values a TokenGenerator builds a token from
+type TokenRequest struct {
+	Credentials     config.Credentials
+	ChannelName     string
+	UidStr          string
+	Role            rtctokenbuilder.Role
+	ExpireTimestamp uint32
+	// CanPublishDataStream grants publishers the data stream privilege used by sendStreamMessage
+	CanPublishDataStream bool
+	// UserAccount is the second identity tokentypes like uidAndUserAccount issue a token for
+	UserAccount string
+}
+
+// TokenGenerator builds one kind of token
+type TokenGenerator interface {
+	Generate(req TokenRequest) (string, error)
+}
+
+// issueToken generates a token with generator and, with TOKEN_AUDIT_LOG set, logs who
+// it was issued for. Only a fingerprint of the token is logged, never the token itself.
+func issueToken(generator TokenGenerator, req TokenRequest) (string, error) {
+	token, err := generator.Generate(req)
+	if err == nil && tokenAuditLog {
+		fingerprint := sha256.Sum256([]byte(token))
+		expires := time.Unix(int64(req.ExpireTimestamp), 0).UTC().Format(time.RFC3339)
+		if _, isRtm := generator.(rtmTokenGenerator); isRtm {
+			logger.Auditf("token issued type=rtm appID=%s uid=%q expires=%s fingerprint=%s",
+				req.Credentials.AppID, req.UidStr, expires, hex.EncodeToString(fingerprint[:])[:8])
+		} else {
+			logger.Auditf("token issued type=rtc appID=%s channel=%q uid=%q role=%s expires=%s fingerprint=%s",
+				req.Credentials.AppID, req.ChannelName, req.UidStr, roleName(req.Role), expires, hex.EncodeToString(fingerprint[:])[:8])
+		}
+	}
+	return token, err
+}
+
+func roleName(role rtctokenbuilder.Role) string {
+	if role == rtctokenbuilder.RolePublisher {
+		return "publisher"
+	}
+	return "subscriber"
+}
+
+// rtcTokenSpec is one of the tokens an rtc tokentype issues
+type rtcTokenSpec struct {
+	// Field is the response field the token is returned in
+	Field     string
+	Generator TokenGenerator
+	// ForUserAccount issues the token for the request's UserAccount instead of its UidStr
+	ForUserAccount bool
+}
+
+// rtcTokenGenerators maps the rtc endpoints' :tokentype param to the tokens it issues.
+// Supporting a new kind of rtc token only needs a new entry here.
+var rtcTokenGenerators = map[string][]rtcTokenSpec{
+	"uid":         {{Field: "rtcToken", Generator: rtcUidTokenGenerator{}}},
+	"userAccount": {{Field: "rtcToken", Generator: rtcUserAccountTokenGenerator{}}},
+	// uidAndUserAccount lets clients decide later whether to join with a uid or a userAccount
+	"uidAndUserAccount": {
+		{Field: "uidRtcToken", Generator: rtcUidTokenGenerator{}},
+		{Field: "userAccountRtcToken", Generator: rtcUserAccountTokenGenerator{}, ForUserAccount: true},
+	},
+}
+
+// rtcTokentypes lists the keys of rtcTokenGenerators in a stable order
+func rtcTokentypes() []string {
+	tokentypes := make([]string, 0, len(rtcTokenGenerators))
+	for tokentype := range rtcTokenGenerators {
+		tokentypes = append(tokentypes, tokentype)
+	}
+	sort.Strings(tokentypes)
+	return tokentypes
+}
+
+// requiresUserAccount reports whether tokentype issues a token for a userAccount besides the uid
+func requiresUserAccount(tokentype string) bool {
+	for _, spec := range rtcTokenGenerators[tokentype] {
+		if spec.ForUserAccount {
+			return true
+		}
+	}
+	return false
+}
+
+// generateRtcTokens issues every token tokentype defines, keyed by response field
+func generateRtcTokens(tokentype string, req TokenRequest) (map[string]string, error) {
+	specs, known := rtcTokenGenerators[tokentype]
+	if !known {
+		err := fmt.Errorf("failed to generate RTC token for Unknown Tokentype: %s", tokentype)
+		logger.Warnf("%s", err)
+		return nil, err
+	}
+
+	tokens := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		tokenReq := req
+		if spec.ForUserAccount {
+			tokenReq.UidStr = req.UserAccount
+		}
+		token, err := issueToken(spec.Generator, tokenReq)
+		if err != nil {
+			return nil, err
+		}
+		tokens[spec.Field] = token
+	}
+	return tokens, nil
+}
+
+// rtcUidTokenGenerator builds rtc tokens for a numeric uid
+type rtcUidTokenGenerator struct{}
+
+func (rtcUidTokenGenerator) Generate(req TokenRequest) (string, error) {
+	// Agora uids are 32-bit unsigned integers. uid 0 is allowed: the token isn't
+	// bound to a uid, which suits clients that let Agora assign one at join time.
+	uid64, parseErr := strconv.ParseUint(req.UidStr, 10, 32)
+	// check if conversion fails or overflows
+	if parseErr != nil {
+		return "", fmt.Errorf("failed to parse uidStr: %s, uid must be an integer from 0 to %d", req.UidStr, uint32(math.MaxUint32))
+	}
+
+	logger.Debugf("Building Token with uid: %d", uid64)
+	// the token builder leaves uid 0 out of the token so it's valid for any uid
+	if uid64 == 0 {
+		return buildRtcToken(req, "")
+	}
+	return buildRtcToken(req, strconv.FormatUint(uid64, 10))
+}
+
+// rtcUserAccountTokenGenerator builds rtc tokens for a string user account
+type rtcUserAccountTokenGenerator struct{}
+
+func (rtcUserAccountTokenGenerator) Generate(req TokenRequest) (string, error) {
+	logger.Debugf("Building Token with userAccount: %s", req.UidStr)
+	return buildRtcToken(req, req.UidStr)
+}
+
+// buildRtcToken mirrors rtctokenbuilder.BuildTokenWithUserAccount, except the data
+// stream privilege is only granted when the request asks for it.
+func buildRtcToken(req TokenRequest, uidStr string) (string, error) {
+	token := accesstoken.CreateAccessToken2(req.Credentials.AppID, req.Credentials.AppCertificate, req.ChannelName, uidStr)
+	token.AddPrivilege(accesstoken.KJoinChannel, req.ExpireTimestamp)
+
+	if req.Role == rtctokenbuilder.RolePublisher {
+		token.AddPrivilege(accesstoken.KPublishVideoStream, req.ExpireTimestamp)
+		token.AddPrivilege(accesstoken.KPublishAudioStream, req.ExpireTimestamp)
+		if req.CanPublishDataStream {
+			token.AddPrivilege(accesstoken.KPublishDataStream, req.ExpireTimestamp)
+		}
+	}
+	return token.Build()
+}
+
+// rtmTokenGenerator builds rtm tokens, which aren't scoped to a channel or role
+type rtmTokenGenerator struct{}
+
+func (rtmTokenGenerator) Generate(req TokenRequest) (string, error) {
+	return rtmtokenbuilder.BuildToken(req.Credentials.AppID, req.Credentials.AppCertificate, req.UidStr, rtmtokenbuilder.RoleRtmUser, req.ExpireTimestamp)
+}
@@ -1,8 +1,10 @@
 module github.com/digitallysavvy/agora-token-server
 
-go 1.14
+go 1.16
 
 require (
 	github.com/AgoraIO-Community/go-tokenbuilder v1.0.0
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-gonic/gin v1.7.7
+	github.com/go-playground/validator/v10 v10.4.1
+	github.com/golang-jwt/jwt/v4 v4.5.2
 )
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitallysavvy/agora-token-server/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// claimsKey is the gin context key holding the validated jwt.MapClaims
+const claimsKey = "jwtClaims"
+
+// userIDKey is the gin context key holding the authenticated user id (the sub claim)
+const userIDKey = "userID"
+
+// jwksRefreshInterval limits how often an unknown key id triggers a JWKS refetch
+const jwksRefreshInterval = time.Minute
+
+// jwtVerifier resolves the key a bearer token was signed with
+type jwtVerifier struct {
+	audience string
+
+	// publicKey is set when a single key is configured
+	publicKey interface{}
+
+	// jwksURL is set when keys are fetched from a JWKS endpoint
+	jwksURL     string
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	lastFetched time.Time
+	// fetching is closed when the JWKS fetch in flight completes, nil when none is
+	fetching chan struct{}
+}
+
+// newJWTVerifier builds a verifier from either a PEM encoded public key or a JWKS URL
+func newJWTVerifier(publicKeyPEM, jwksURL, audience string) (*jwtVerifier, error) {
+	verifier := &jwtVerifier{audience: audience, jwksURL: jwksURL}
+	if publicKeyPEM == "" {
+		return verifier, verifier.fetchKeys()
+	}
+
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyPEM)); err == nil {
+		verifier.publicKey = rsaKey
+	} else if ecKey, err := jwt.ParseECPublicKeyFromPEM([]byte(publicKeyPEM)); err == nil {
+		verifier.publicKey = ecKey
+	} else {
+		return nil, errors.New("JWT public key must be a PEM encoded RSA or ECDSA key")
+	}
+	return verifier, nil
+}
+
+// JWTAuth rejects requests without a valid bearer token and stores the token's
+// claims and subject on the context for downstream handlers.
+func JWTAuth(verifier *jwtVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bearer := c.GetHeader("Authorization")
+		if !strings.HasPrefix(bearer, "Bearer ") {
+			abortWithError(c, 401, "missing bearer token")
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(strings.TrimPrefix(bearer, "Bearer "), claims, verifier.keyFunc)
+		if err == nil && !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+			err = errors.New("token has no expiration")
+		}
+		if err == nil && verifier.audience != "" && !claims.VerifyAudience(verifier.audience, true) {
+			err = fmt.Errorf("token is not issued for audience: %s", verifier.audience)
+		}
+		if err != nil {
+			c.Error(err)
+			abortWithError(c, 401, "invalid bearer token: "+err.Error())
+			return
+		}
+
+		userID, _ := claims["sub"].(string)
+		logger.Debugf("authenticated user: %s", userID)
+		c.Set(claimsKey, claims)
+		c.Set(userIDKey, userID)
+	}
+}
+
+// keyFunc returns the verification key for a parsed token, only accepting
+// signing methods that match the key's type.
+func (verifier *jwtVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	key := verifier.publicKey
+	if verifier.jwksURL != "" {
+		kid, _ := token.Header["kid"].(string)
+		var err error
+		if key, err = verifier.jwksKey(kid); err != nil {
+			return nil, err
+		}
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, isRSA := token.Method.(*jwt.SigningMethodRSA); !isRSA {
+			if _, isPSS := token.Method.(*jwt.SigningMethodRSAPSS); !isPSS {
+				return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+			}
+		}
+	case *ecdsa.PublicKey:
+		if _, isECDSA := token.Method.(*jwt.SigningMethodECDSA); !isECDSA {
+			return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+		}
+	}
+	return key, nil
+}
+
+// jwksKey looks up a key by id, refetching the key set at most once per
+// jwksRefreshInterval so rotated keys are picked up. The fetch runs without holding
+// mu so lookups of known keys never wait on the network; lookups of unknown keys
+// during a fetch wait for it instead of starting another.
+func (verifier *jwtVerifier) jwksKey(kid string) (interface{}, error) {
+	verifier.mu.Lock()
+	if key, keyExists := verifier.keys[kid]; keyExists {
+		verifier.mu.Unlock()
+		return key, nil
+	}
+
+	if fetching := verifier.fetching; fetching != nil {
+		verifier.mu.Unlock()
+		<-fetching
+		return verifier.cachedKey(kid)
+	}
+	if time.Since(verifier.lastFetched) <= jwksRefreshInterval {
+		verifier.mu.Unlock()
+		return nil, fmt.Errorf("unknown signing key id: %s", kid)
+	}
+	fetching := make(chan struct{})
+	verifier.fetching = fetching
+	verifier.lastFetched = time.Now()
+	verifier.mu.Unlock()
+
+	keys, err := verifier.fetchKeySet()
+
+	verifier.mu.Lock()
+	if err == nil {
+		verifier.keys = keys
+	}
+	verifier.fetching = nil
+	close(fetching)
+	verifier.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return verifier.cachedKey(kid)
+}
+
+func (verifier *jwtVerifier) cachedKey(kid string) (interface{}, error) {
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	if key, keyExists := verifier.keys[kid]; keyExists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key id: %s", kid)
+}
+
+func (verifier *jwtVerifier) fetchKeys() error {
+	keys, err := verifier.fetchKeySet()
+	if err != nil {
+		return err
+	}
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	verifier.keys = keys
+	verifier.lastFetched = time.Now()
+	return nil
+}
+
+// jsonWebKey holds the fields of a JWK needed to build RSA and EC public keys
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeySet downloads and parses the JWKS without touching the verifier's cached keys
+func (verifier *jwtVerifier) fetchKeySet() (map[string]interface{}, error) {
+	logger.Debugf("fetching JWKS: %s", verifier.jwksURL)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(verifier.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s, causing error: %s", verifier.jwksURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s, status: %d", verifier.jwksURL, resp.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS, causing error: %s", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.Warnf("skipping JWKS key: %s, causing error: %s", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+		if nErr != nil || eErr != nil {
+			return nil, errors.New("malformed RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, xErr := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, yErr := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if xErr != nil || yErr != nil {
+			return nil, errors.New("malformed EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+	}
+}
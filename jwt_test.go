@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// testJWKS serves the public halves of keys as a JWKS, counting fetches
+type testJWKS struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	delay   time.Duration
+	fetches int32
+}
+
+func (jwks *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&jwks.fetches, 1)
+	time.Sleep(jwks.delay)
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for kid, key := range jwks.keys {
+		keySet.Keys = append(keySet.Keys, jsonWebKey{
+			Kid: kid,
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(keySet)
+}
+
+func (jwks *testJWKS) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key := newRSAKey(t)
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+	jwks.keys[kid] = key
+	return key
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key failed: %s", err)
+	}
+	return key
+}
+
+func publicKeyPEM(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("encoding RSA public key failed: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func signJWT(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing JWT failed: %s", err)
+	}
+	return signed
+}
+
+// authenticate sends bearer through JWTAuth, returning the status and the user id it set
+func authenticate(t *testing.T, verifier *jwtVerifier, bearer string) (int, string) {
+	t.Helper()
+	router := gin.New()
+	router.Use(JWTAuth(verifier))
+	router.GET("/", func(c *gin.Context) {
+		c.JSON(200, gin.H{"userID": c.GetString(userIDKey)})
+	})
+
+	request := httptest.NewRequest("GET", "/", nil)
+	if bearer != "" {
+		request.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	var response struct {
+		UserID string `json:"userID"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response.UserID
+}
+
+func TestJWTAuth(t *testing.T) {
+	key := newRSAKey(t)
+	publicPEM := publicKeyPEM(t, key)
+	verifier, err := newJWTVerifier(publicPEM, "", "tokens")
+	if err != nil {
+		t.Fatalf("newJWTVerifier failed: %s", err)
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name     string
+		bearer   string
+		wantCode int
+	}{
+		{"valid", signJWT(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "alice", "aud": "tokens", "exp": expires}), 200},
+		{"missing", "", 401},
+		// signing with the public key as an HMAC secret must not pass as an RSA signature
+		{"HS256 with the RSA public key", signJWT(t, jwt.SigningMethodHS256, []byte(publicPEM), "", jwt.MapClaims{"sub": "alice", "aud": "tokens", "exp": expires}), 401},
+		{"missing exp", signJWT(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "alice", "aud": "tokens"}), 401},
+		{"expired", signJWT(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "alice", "aud": "tokens", "exp": time.Now().Add(-time.Minute).Unix()}), 401},
+		{"wrong aud", signJWT(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "alice", "aud": "other", "exp": expires}), 401},
+		{"other key", signJWT(t, jwt.SigningMethodRS256, newRSAKey(t), "", jwt.MapClaims{"sub": "alice", "aud": "tokens", "exp": expires}), 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, userID := authenticate(t, verifier, test.bearer)
+			if code != test.wantCode {
+				t.Fatalf("JWTAuth responded %d, want %d", code, test.wantCode)
+			}
+			if code == 200 && userID != "alice" {
+				t.Errorf("JWTAuth set user %q, want alice", userID)
+			}
+		})
+	}
+}
+
+func TestJWTAuthJWKSRefetch(t *testing.T) {
+	jwks := &testJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	firstKey := jwks.addKey(t, "first")
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	verifier, err := newJWTVerifier("", server.URL, "")
+	if err != nil {
+		t.Fatalf("newJWTVerifier failed: %s", err)
+	}
+	claims := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	if code, _ := authenticate(t, verifier, signJWT(t, jwt.SigningMethodRS256, firstKey, "first", claims)); code != 200 {
+		t.Fatalf("JWTAuth with a known kid responded %d", code)
+	}
+
+	// a rotated key isn't picked up until jwksRefreshInterval has passed
+	rotatedKey := jwks.addKey(t, "rotated")
+	rotated := signJWT(t, jwt.SigningMethodRS256, rotatedKey, "rotated", claims)
+	if code, _ := authenticate(t, verifier, rotated); code != 401 {
+		t.Errorf("JWTAuth with an unknown kid inside the refresh interval responded %d, want 401", code)
+	}
+	if fetches := atomic.LoadInt32(&jwks.fetches); fetches != 1 {
+		t.Errorf("JWKS fetched %d times inside the refresh interval, want 1", fetches)
+	}
+
+	verifier.mu.Lock()
+	verifier.lastFetched = time.Now().Add(-2 * jwksRefreshInterval)
+	verifier.mu.Unlock()
+	if code, _ := authenticate(t, verifier, rotated); code != 200 {
+		t.Errorf("JWTAuth with a rotated kid after the refresh interval responded %d, want 200", code)
+	}
+	if code, _ := authenticate(t, verifier, signJWT(t, jwt.SigningMethodRS256, newRSAKey(t), "unknown", claims)); code != 401 {
+		t.Errorf("JWTAuth with an unknown kid responded %d, want 401", code)
+	}
+	if fetches := atomic.LoadInt32(&jwks.fetches); fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", fetches)
+	}
+}
+
+func TestJWKSKeyWaitersShareFetch(t *testing.T) {
+	jwks := &testJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	jwks.addKey(t, "known")
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	verifier, err := newJWTVerifier("", server.URL, "")
+	if err != nil {
+		t.Fatalf("newJWTVerifier failed: %s", err)
+	}
+	jwks.addKey(t, "rotated")
+	jwks.delay = 200 * time.Millisecond
+	verifier.mu.Lock()
+	verifier.lastFetched = time.Time{}
+	verifier.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.jwksKey("rotated")
+			errs <- err
+		}()
+	}
+
+	// known keys are served while the fetch is in flight
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := verifier.jwksKey("known"); err != nil {
+		t.Errorf("jwksKey for a known kid failed: %s", err)
+	}
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("jwksKey for a known kid waited %s on the fetch", waited)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("jwksKey for a rotated kid failed: %s", err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&jwks.fetches); fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2: one at startup and one shared by every waiter", fetches)
+	}
+}
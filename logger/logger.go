@@ -0,0 +1,91 @@
+// Package logger is a leveled wrapper around the standard log package.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the minimum severity a message needs to be logged
+type Level int
+
+// Levels from most to least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// level is set once at startup, before any requests are served
+var level = LevelInfo
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel reads a level name such as the one set in LOG_LEVEL
+func ParseLevel(name string) (Level, error) {
+	for l, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %s, must be debug, info, warn or error", name)
+}
+
+// SetLevel changes the minimum level messages are logged at
+func SetLevel(l Level) {
+	level = l
+}
+
+// Enabled reports whether messages at l are logged, for skipping expensive debug output
+func Enabled(l Level) bool {
+	return l >= level
+}
+
+// Debugf logs detail useful while diagnosing an incident
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+// Infof logs routine events
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+// Warnf logs problems the server recovered from
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+// Errorf logs failures that need attention
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+// Auditf logs an audit trail entry regardless of level, so turning verbosity down
+// never drops it
+func Auditf(format string, args ...interface{}) {
+	log.Printf("AUDIT "+format, args...)
+}
+
+// Fatalf logs regardless of level and exits
+func Fatalf(format string, args ...interface{}) {
+	log.Fatalf("FATAL "+format, args...)
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	log.Printf(strings.ToUpper(l.String())+" "+format, args...)
+}
@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// redactedValue replaces the value of every sensitive field
+const redactedValue = "[REDACTED]"
+
+// sensitiveFields are matched case-insensitively against JSON object keys
+var sensitiveFields = []string{
+	"secretKey",
+	"accessKey",
+	"token",
+	"appCertificate",
+	"customerCertificate",
+	"authorization",
+}
+
+// Redact returns a copy of a JSON payload with the values of sensitive fields
+// masked at any depth, so it can be logged. Payloads that aren't valid JSON
+// can't be inspected and are replaced entirely.
+func Redact(payload []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []byte(redactedValue)
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return []byte(redactedValue)
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isSensitive(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+func isSensitive(key string) bool {
+	for _, field := range sensitiveFields {
+		if strings.EqualFold(key, field) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package logger
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		secrets []string
+		want    string
+	}{
+		{
+			name:    "top level fields",
+			payload: `{"token":"006tokenvalue","appCertificate":"certvalue","channelName":"room"}`,
+			secrets: []string{"006tokenvalue", "certvalue"},
+			want:    `{"appCertificate":"[REDACTED]","channelName":"room","token":"[REDACTED]"}`,
+		},
+		{
+			name:    "nested objects",
+			payload: `{"startParameter":{"storageConfig":{"accessKey":"akvalue","secretKey":"skvalue","bucket":"b"}}}`,
+			secrets: []string{"akvalue", "skvalue"},
+			want:    `{"startParameter":{"storageConfig":{"accessKey":"[REDACTED]","bucket":"b","secretKey":"[REDACTED]"}}}`,
+		},
+		{
+			name:    "arrays",
+			payload: `{"configs":[{"customerCertificate":"ccvalue"},{"token":{"nested":"objectvalue"}}],"ok":[1,2.50]}`,
+			secrets: []string{"ccvalue", "objectvalue"},
+			want:    `{"configs":[{"customerCertificate":"[REDACTED]"},{"token":"[REDACTED]"}],"ok":[1,2.50]}`,
+		},
+		{
+			name:    "case insensitive keys",
+			payload: `{"SecretKey":"skvalue","TOKEN":"tokenvalue","Authorization":"Bearer jwtvalue"}`,
+			secrets: []string{"skvalue", "tokenvalue", "jwtvalue"},
+			want:    `{"Authorization":"[REDACTED]","SecretKey":"[REDACTED]","TOKEN":"[REDACTED]"}`,
+		},
+		{
+			name:    "non JSON input",
+			payload: `token=tokenvalue&secretKey=skvalue`,
+			secrets: []string{"tokenvalue", "skvalue"},
+			want:    `[REDACTED]`,
+		},
+		{
+			name:    "truncated JSON",
+			payload: `{"channelName":"room","token":"tokenvalue"`,
+			secrets: []string{"tokenvalue"},
+			want:    `[REDACTED]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redacted := string(Redact([]byte(test.payload)))
+			for _, secret := range test.secrets {
+				if strings.Contains(redacted, secret) {
+					t.Errorf("Redact(%s) = %s, still contains %q", test.payload, redacted, secret)
+				}
+			}
+			if redacted != test.want {
+				t.Errorf("Redact(%s) = %s, want %s", test.payload, redacted, test.want)
+			}
+			if test.want != redactedValue && !json.Valid([]byte(redacted)) {
+				t.Errorf("Redact(%s) = %s, not valid JSON", test.payload, redacted)
+			}
+		})
+	}
+}
@@ -1,33 +1,107 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/AgoraIO-Community/go-tokenbuilder/accesstoken"
 	"github.com/AgoraIO-Community/go-tokenbuilder/rtctokenbuilder"
-	"github.com/AgoraIO-Community/go-tokenbuilder/rtmtokenbuilder"
+	"github.com/digitallysavvy/agora-token-server/config"
+	"github.com/digitallysavvy/agora-token-server/logger"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 )
 
-var appID string
-var appCertificate string
+// gitCommit and buildTime are set at build time with
+// -ldflags "-X main.gitCommit=... -X main.buildTime=..."
+var gitCommit = "dev"
+var buildTime = "dev"
+
+// defaultCredentials sign tokens for requests that don't name a tenant, nil when unset
+var defaultCredentials *config.Credentials
+
+// tenantCredentials maps a tenant identifier to the app credentials used for its tokens
+var tenantCredentials map[string]config.Credentials
+
+// trustJWTUID issues tokens for the authenticated sub claim rather than the requested uid
+var trustJWTUID bool
+
+// tokenAuditLog logs every issued token's identity and fingerprint
+var tokenAuditLog bool
+
+// strictJSON rejects request bodies with fields the endpoint doesn't define
+var strictJSON bool
+
+// tenantHeader names the request header used to select a tenant's credentials
+const tenantHeader = "X-Tenant-ID"
+
+// credentialsKey is the gin context key holding the credentials for the current request
+const credentialsKey = "credentials"
+
+// defaultExpireTime is the token lifetime in seconds used when a request doesn't set one
+var defaultExpireTime uint32
+
+// guestMaxExpireTime caps the lifetime in seconds of tokens requested with guest=true
+var guestMaxExpireTime uint32
+
+// defaultMaxBodyBytes caps the size of request bodies the server will read
+var defaultMaxBodyBytes int64
+
+// tokenMaxBodyBytes is the tighter cap applied to the token POST routes
+const tokenMaxBodyBytes int64 = 16 << 10
 
 func main() {
 
-	appIDEnv, appIDExists := os.LookupEnv("APP_ID")
-	appCertEnv, appCertExists := os.LookupEnv("APP_CERTIFICATE")
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.SetLevel(cfg.LogLevel)
+
+	defaultCredentials = cfg.Default
+	tenantCredentials = cfg.Tenants
+	trustJWTUID = cfg.TrustJWTUID
+	strictJSON = cfg.StrictJSON
+	tokenAuditLog = cfg.TokenAuditLog
+	encryptionScheme = cfg.EncryptionScheme
+	encryptionKey = cfg.EncryptionKey
+	encryptionCacheSize = cfg.EncryptionCacheSize
+	defaultExpireTime = cfg.TokenExpireSeconds
+	guestMaxExpireTime = cfg.GuestMaxExpireSeconds
+	defaultMaxBodyBytes = cfg.MaxBodyBytes
+
+	useJSONFieldNames()
+	api := gin.Default()
 
-	if !appIDExists || !appCertExists {
-		log.Fatal("FATAL ERROR: ENV not properly configured, check appID and appCertificate")
-	} else {
-		appID = appIDEnv
-		appCertificate = appCertEnv
+	// Without trusted proxies c.ClientIP() is the connection's remote address. Trusting
+	// a proxy lets it set the client IP through X-Forwarded-For, so only list proxies
+	// you control or any client could spoof its address.
+	if proxyErr := api.SetTrustedProxies(cfg.TrustedProxies); proxyErr != nil {
+		logger.Fatalf("invalid TRUSTED_PROXIES, causing error: %s", proxyErr)
 	}
 
-	api := gin.Default()
+	// tracing is registered first so the span covers every other middleware
+	if cfg.OTLPEndpoint != "" {
+		exporter := newSpanExporter(cfg.OTLPEndpoint, cfg.ServiceName)
+		go exporter.run()
+		api.Use(Tracing(exporter))
+	}
 
 	api.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -35,13 +109,199 @@ func main() {
 		})
 	})
 
+	api.GET("/healthz", getHealth)
+
+	api.GET("/version", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"gitCommit": gitCommit,
+			"buildTime": buildTime,
+			"goVersion": runtime.Version(),
+		})
+	})
+
+	api.GET("/token/types", getTokenTypes)
+
 	api.Use(nocache())
-	api.GET("rtc/:channelName/:role/:tokentype/:uid/", getRtcToken)
-	api.GET("rtm/:uid/", getRtmToken)
-	api.GET("rte/:channelName/:role/:tokentype/:uid/", getBothTokens)
+	api.Use(MaxBodyBytes(defaultMaxBodyBytes))
+
+	// authentication and tenant resolution only wrap the token routes; gin runs engine
+	// middleware before NoRoute/NoMethod, which would turn 404s and 405s into 400s/401s
+	tokens := api.Group("/")
+	if cfg.JWTEnabled() {
+		verifier, jwtErr := newJWTVerifier(cfg.JWTPublicKey, cfg.JWTJWKSURL, cfg.JWTAudience)
+		if jwtErr != nil {
+			logger.Fatalf("%s", jwtErr)
+		}
+		tokens.Use(JWTAuth(verifier))
+	}
+	tokens.Use(appCredentials())
+	for _, tt := range tokenTypes {
+		tokens.Handle(tt.Method, tt.Path, tt.handlers...)
+	}
+
+	api.HandleMethodNotAllowed = true
+	api.NoRoute(func(c *gin.Context) {
+		abortWithError(c, 404, "No route matches "+c.Request.URL.Path)
+	})
+	api.NoMethod(func(c *gin.Context) {
+		c.Header("Allow", strings.Join(allowedMethods(api.Routes(), c.Request.URL.Path), ", "))
+		abortWithError(c, 405, c.Request.Method+" is not allowed on "+c.Request.URL.Path)
+	})
+
 	api.Run(":8080") // listen and serve on localhost:8080
 }
 
+// allowedMethods lists the methods of every registered route matching path
+func allowedMethods(routes gin.RoutesInfo, path string) []string {
+	var methods []string
+	for _, route := range routes {
+		if routeMatches(route.Path, path) && !containsString(methods, route.Method) {
+			methods = append(methods, route.Method)
+		}
+	}
+	return methods
+}
+
+// routeMatches reports whether path matches a gin route pattern with :param and *wildcard segments
+func routeMatches(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+		if i >= len(pathParts) || (!strings.HasPrefix(part, ":") && part != pathParts[i]) {
+			return false
+		}
+	}
+	return len(patternParts) == len(pathParts)
+}
+
+// tokenType describes a token endpoint. The same entries register the routes and are
+// listed by token/types, so the listing can't drift from what is served.
+type tokenType struct {
+	Type     string   `json:"type"`
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	Required []string `json:"required"`
+	Optional []string `json:"optional"`
+	// Tokentypes are the accepted tokentype values, for endpoints that take one
+	Tokentypes []string `json:"tokentypes,omitempty"`
+	handlers   []gin.HandlerFunc
+}
+
+var tokenTypes = []tokenType{
+	{
+		Type:       "rtc",
+		Method:     "GET",
+		Path:       "rtc/:channelName/:role/:tokentype/:uid/",
+		Required:   []string{"channelName", "role", "tokentype", "uid"},
+		Optional:   []string{"expiry", "canPublishDataStream", "userAccount", "encryption", "guest"},
+		Tokentypes: rtcTokentypes(),
+		handlers:   []gin.HandlerFunc{getRtcToken},
+	},
+	{
+		Type:     "rtm",
+		Method:   "GET",
+		Path:     "rtm/:uid/",
+		Required: []string{"uid"},
+		Optional: []string{"expiry"},
+		handlers: []gin.HandlerFunc{getRtmToken},
+	},
+	{
+		Type:       "rte",
+		Method:     "GET",
+		Path:       "rte/:channelName/:role/:tokentype/:uid/",
+		Required:   []string{"channelName", "role", "tokentype", "uid"},
+		Optional:   []string{"expiry", "canPublishDataStream", "userAccount", "encryption", "guest"},
+		Tokentypes: rtcTokentypes(),
+		handlers:   []gin.HandlerFunc{getBothTokens},
+	},
+	{
+		Type:       "rtcForChannels",
+		Method:     "POST",
+		Path:       "token/getForChannels",
+		Required:   []string{"channels", "tokentype", "uid"},
+		Optional:   []string{"role", "expiry", "canPublishDataStream", "userAccount"},
+		Tokentypes: rtcTokentypes(),
+		handlers:   []gin.HandlerFunc{MaxBodyBytes(tokenMaxBodyBytes), getTokensForChannels},
+	},
+	{
+		Type:     "rtcRenew",
+		Method:   "POST",
+		Path:     "token/renew",
+		Required: []string{"token", "channelName", "uid"},
+		Optional: []string{"expiry"},
+		handlers: []gin.HandlerFunc{MaxBodyBytes(tokenMaxBodyBytes), renewRtcToken},
+	},
+}
+
+func getTokenTypes(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"tokenTypes": tokenTypes,
+	})
+}
+
+// getHealth reports unhealthy when any configured credentials fail the token self-test
+func getHealth(c *gin.Context) {
+	var failures []string
+	if defaultCredentials != nil {
+		if err := selfTestCredentials(*defaultCredentials); err != nil {
+			failures = append(failures, "default credentials: "+err.Error())
+		}
+	}
+	for tenant, creds := range tenantCredentials {
+		if err := selfTestCredentials(creds); err != nil {
+			failures = append(failures, "tenant "+tenant+": "+err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		// /healthz is unauthenticated, so which tenants failed is only logged
+		logger.Errorf("health check failed: %s", strings.Join(failures, "; "))
+		abortWithError(c, 503, fmt.Sprintf("health check failed for %d credentials", len(failures)))
+		return
+	}
+	c.JSON(200, gin.H{
+		"healthy": true,
+	})
+}
+
+// selfTestCredentials checks the credentials look like Agora's 32 character hex values,
+// then builds a token for a dummy channel and uid and verifies it round trips.
+func selfTestCredentials(creds config.Credentials) error {
+	if !isAgoraHex(creds.AppID) {
+		return fmt.Errorf("appID is not a 32 character hex string")
+	}
+	if !isAgoraHex(creds.AppCertificate) {
+		return fmt.Errorf("appCertificate is not a 32 character hex string")
+	}
+
+	req := TokenRequest{
+		Credentials:     creds,
+		ChannelName:     "healthcheck",
+		UidStr:          "1",
+		Role:            rtctokenbuilder.RoleSubscriber,
+		ExpireTimestamp: uint32(time.Now().UTC().Unix()) + 60,
+	}
+	token, err := buildRtcToken(req, req.UidStr)
+	if err != nil {
+		return fmt.Errorf("failed to build token: %s", err)
+	}
+	if _, _, err := verifyRtcToken(creds, token, req.ChannelName, req.UidStr); err != nil {
+		return fmt.Errorf("built token failed to verify: %s", err)
+	}
+	return nil
+}
+
+func isAgoraHex(value string) bool {
+	if len(value) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
 func nocache() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// set headers
@@ -52,64 +312,135 @@ func nocache() gin.HandlerFunc {
 	}
 }
 
+// MaxBodyBytes rejects requests whose body is larger than n bytes with a 413.
+// The body is read up front so handlers binding JSON never see a truncated stream.
+func MaxBodyBytes(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, n))
+		if err != nil {
+			c.Error(err)
+			if int64(len(body)) < n {
+				// the client went away before the limit was reached
+				abortWithError(c, 400, "Error reading request body: "+err.Error())
+				return
+			}
+			abortWithError(c, 413, fmt.Sprintf("Request body exceeds the %d byte limit", n))
+			return
+		}
+		if len(body) > 0 && logger.Enabled(logger.LevelDebug) {
+			logger.Debugf("read %d byte request body: %s", len(body), logger.Redact(body))
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+}
+
+// appCredentials resolves the app credentials for the tenant named in the request
+// and stores them on the context for the token handlers.
+func appCredentials() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		creds, err := lookupCredentials(c.GetHeader(tenantHeader))
+		if err != nil {
+			c.Error(err)
+			abortWithError(c, 400, err.Error())
+			return
+		}
+		c.Set(credentialsKey, creds)
+	}
+}
+
+func lookupCredentials(tenant string) (config.Credentials, error) {
+	if tenant == "" {
+		if defaultCredentials != nil {
+			return *defaultCredentials, nil
+		}
+		// a single configured tenant doesn't need to be named
+		if len(tenantCredentials) == 1 {
+			for _, creds := range tenantCredentials {
+				return creds, nil
+			}
+		}
+		return config.Credentials{}, fmt.Errorf("missing %s header", tenantHeader)
+	}
+
+	creds, tenantExists := tenantCredentials[tenant]
+	if !tenantExists {
+		return config.Credentials{}, fmt.Errorf("unknown tenant: %s", tenant)
+	}
+	return creds, nil
+}
+
 func getRtcToken(c *gin.Context) {
-	log.Printf("rtc token\n")
+	logger.Debugf("rtc token")
 	// get param values
-	channelName, tokentype, uidStr, role, expireTimestamp, err := parseRtcParams(c)
+	tokentype, tokenReq, err := parseRtcParams(c)
 
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(400, gin.H{
-			"message": "Error Generating RTC token: " + err.Error(),
-			"status":  400,
-		})
+		abortWithError(c, 400, "Error Generating RTC token: "+err.Error())
+		return
+	}
+
+	if !authorizeToken(c, tokenReq) {
+		return
+	}
+
+	encryption, encryptionErr := requestedEncryption(c, tokenReq.Credentials, tokenReq.ChannelName)
+	if encryptionErr != nil {
+		c.Error(encryptionErr)
+		abortWithError(c, encryptionErrorStatus(encryptionErr), "Error Generating RTC token: "+encryptionErr.Error())
 		return
 	}
 
-	rtcToken, tokenErr := generateRtcToken(channelName, uidStr, tokentype, role, expireTimestamp)
+	rtcTokens, tokenErr := generateRtcTokens(tokentype, tokenReq)
 
 	if tokenErr != nil {
-		log.Println(tokenErr) // token failed to generate
+		logger.Warnf("%s", tokenErr) // token failed to generate
 		c.Error(tokenErr)
 		errMsg := "Error Generating RTC token - " + tokenErr.Error()
-		c.AbortWithStatusJSON(400, gin.H{
-			"status": 400,
-			"error":  errMsg,
-		})
+		abortWithError(c, 400, errMsg)
 	} else {
-		log.Println("RTC Token generated")
-		c.JSON(200, gin.H{
-			"rtcToken": rtcToken,
-		})
+		logger.Infof("RTC Token generated")
+		c.JSON(200, withEncryption(tokenResponse(rtcTokens), encryption))
 	}
 }
 
+// tokenResponse returns generated tokens keyed by their response fields
+func tokenResponse(tokens map[string]string) gin.H {
+	response := gin.H{}
+	for field, token := range tokens {
+		response[field] = token
+	}
+	return response
+}
+
 func getRtmToken(c *gin.Context) {
-	log.Printf("rtm token\n")
+	logger.Debugf("rtm token")
 	// get param values
 	uidStr, expireTimestamp, err := parseRtmParams(c)
 
 	if err != nil {
 		c.Error(err)
-		c.AbortWithStatusJSON(400, gin.H{
-			"message": "Error Generating RTC token: " + err.Error(),
-			"status":  400,
-		})
+		abortWithError(c, 400, "Error Generating RTC token: "+err.Error())
 		return
 	}
 
-	rtmToken, tokenErr := rtmtokenbuilder.BuildToken(appID, appCertificate, uidStr, rtmtokenbuilder.RoleRtmUser, expireTimestamp)
+	creds := c.MustGet(credentialsKey).(config.Credentials)
+	rtmReq := TokenRequest{Credentials: creds, UidStr: uidStr, Role: rtctokenbuilder.RoleSubscriber, ExpireTimestamp: expireTimestamp}
+	if !authorizeToken(c, rtmReq) {
+		return
+	}
+	rtmToken, tokenErr := issueToken(rtmTokenGenerator{}, rtmReq)
 
 	if tokenErr != nil {
-		log.Println(tokenErr) // token failed to generate
+		logger.Warnf("%s", tokenErr) // token failed to generate
 		c.Error(tokenErr)
 		errMsg := "Error Generating RTM token: " + tokenErr.Error()
-		c.AbortWithStatusJSON(400, gin.H{
-			"error":  errMsg,
-			"status": 400,
-		})
+		abortWithError(c, 400, errMsg)
 	} else {
-		log.Println("RTM Token generated")
+		logger.Infof("RTM Token generated")
 		c.JSON(200, gin.H{
 			"rtmToken": rtmToken,
 		})
@@ -117,61 +448,98 @@ func getRtmToken(c *gin.Context) {
 }
 
 func getBothTokens(c *gin.Context) {
-	log.Printf("dual token\n")
+	logger.Debugf("dual token")
 	// get rtc param values
-	channelName, tokentype, uidStr, role, expireTimestamp, rtcParamErr := parseRtcParams(c)
+	tokentype, tokenReq, rtcParamErr := parseRtcParams(c)
 
 	if rtcParamErr != nil {
 		c.Error(rtcParamErr)
-		c.AbortWithStatusJSON(400, gin.H{
-			"message": "Error Generating RTC token: " + rtcParamErr.Error(),
-			"status":  400,
-		})
+		abortWithError(c, 400, "Error Generating RTC token: "+rtcParamErr.Error())
+		return
+	}
+	if !authorizeToken(c, tokenReq) {
+		return
+	}
+	encryption, encryptionErr := requestedEncryption(c, tokenReq.Credentials, tokenReq.ChannelName)
+	if encryptionErr != nil {
+		c.Error(encryptionErr)
+		abortWithError(c, encryptionErrorStatus(encryptionErr), "Error Generating RTC token: "+encryptionErr.Error())
 		return
 	}
 	// generate the rtcToken
-	rtcToken, rtcTokenErr := generateRtcToken(channelName, uidStr, tokentype, role, expireTimestamp)
+	rtcTokens, rtcTokenErr := generateRtcTokens(tokentype, tokenReq)
 	// generate rtmToken
-	rtmToken, rtmTokenErr := rtmtokenbuilder.BuildToken(appID, appCertificate, uidStr, rtmtokenbuilder.RoleRtmUser, expireTimestamp)
+	rtmToken, rtmTokenErr := issueToken(rtmTokenGenerator{}, tokenReq)
 
 	if rtcTokenErr != nil {
-		log.Println(rtcTokenErr) // token failed to generate
+		logger.Warnf("%s", rtcTokenErr) // token failed to generate
 		c.Error(rtcTokenErr)
 		errMsg := "Error Generating RTC token - " + rtcTokenErr.Error()
-		c.AbortWithStatusJSON(400, gin.H{
-			"status": 400,
-			"error":  errMsg,
-		})
+		abortWithError(c, 400, errMsg)
 	} else if rtmTokenErr != nil {
-		log.Println(rtmTokenErr) // token failed to generate
+		logger.Warnf("%s", rtmTokenErr) // token failed to generate
 		c.Error(rtmTokenErr)
 		errMsg := "Error Generating RTC token - " + rtmTokenErr.Error()
-		c.AbortWithStatusJSON(400, gin.H{
-			"status": 400,
-			"error":  errMsg,
-		})
+		abortWithError(c, 400, errMsg)
 	} else {
-		log.Println("RTC Token generated")
-		c.JSON(200, gin.H{
-			"rtcToken": rtcToken,
-			"rtmToken": rtmToken,
-		})
+		logger.Infof("RTC Token generated")
+		response := tokenResponse(rtcTokens)
+		response["rtmToken"] = rtmToken
+		c.JSON(200, withEncryption(response, encryption))
 	}
 
 }
 
-func parseRtcParams(c *gin.Context) (channelName, tokentype, uidStr string, role rtctokenbuilder.Role, expireTimestamp uint32, err error) {
+func parseRtcParams(c *gin.Context) (tokentype string, req TokenRequest, err error) {
+	req.Credentials = c.MustGet(credentialsKey).(config.Credentials)
 	// get param values
-	channelName = c.Param("channelName")
+	req.ChannelName = c.Param("channelName")
+	if err = ValidateChannelName(req.ChannelName); err != nil {
+		return tokentype, req, err
+	}
 	roleStr := c.Param("role")
 	tokentype = c.Param("tokentype")
-	uidStr = c.Param("uid")
-	expireTime := c.DefaultQuery("expiry", "3600")
+	if req.UidStr, err = resolveUid(c, c.Param("uid")); err != nil {
+		return tokentype, req, err
+	}
+	if requiresUserAccount(tokentype) {
+		if req.UserAccount, err = resolveUid(c, c.Query("userAccount")); err != nil {
+			return tokentype, req, err
+		}
+		if req.UserAccount == "" {
+			return tokentype, req, fmt.Errorf("tokentype %s requires a userAccount query param", tokentype)
+		}
+	}
+	expireTime := c.DefaultQuery("expiry", strconv.FormatUint(uint64(defaultExpireTime), 10))
+	canPublishDataStream := c.DefaultQuery("canPublishDataStream", "true")
+
+	guestParam := c.DefaultQuery("guest", "false")
+	guest, guestErr := strconv.ParseBool(guestParam)
+	if guestErr != nil {
+		return tokentype, req, fmt.Errorf("failed to parse guest: %s, causing error: %s", guestParam, guestErr)
+	}
+	if guest {
+		// guests only ever subscribe, for at most guestMaxExpireTime
+		if roleStr == "publisher" {
+			return tokentype, req, errors.New("guest tokens can't be issued for the publisher role")
+		}
+		if publish, _ := strconv.ParseBool(c.Query("canPublishDataStream")); publish {
+			return tokentype, req, errors.New("guest tokens can't publish data streams")
+		}
+		canPublishDataStream = "false"
+		if expireTime64, parseErr := strconv.ParseUint(expireTime, 10, 64); parseErr == nil && expireTime64 > uint64(guestMaxExpireTime) {
+			expireTime = strconv.FormatUint(uint64(guestMaxExpireTime), 10)
+		}
+	}
 
 	if roleStr == "publisher" {
-		role = rtctokenbuilder.RolePublisher
+		req.Role = rtctokenbuilder.RolePublisher
 	} else {
-		role = rtctokenbuilder.RoleSubscriber
+		req.Role = rtctokenbuilder.RoleSubscriber
+	}
+
+	if req.CanPublishDataStream, err = strconv.ParseBool(canPublishDataStream); err != nil {
+		return tokentype, req, fmt.Errorf("failed to parse canPublishDataStream: %s, causing error: %s", canPublishDataStream, err)
 	}
 
 	expireTime64, parseErr := strconv.ParseUint(expireTime, 10, 64)
@@ -183,15 +551,57 @@ func parseRtcParams(c *gin.Context) (channelName, tokentype, uidStr string, role
 	// set timestamps
 	expireTimeInSeconds := uint32(expireTime64)
 	currentTimestamp := uint32(time.Now().UTC().Unix())
-	expireTimestamp = currentTimestamp + expireTimeInSeconds
+	req.ExpireTimestamp = currentTimestamp + expireTimeInSeconds
 
-	return channelName, tokentype, uidStr, role, expireTimestamp, err
+	return tokentype, req, err
+}
+
+// channelNameSpecialChars are the non-alphanumeric characters Agora accepts in a channel name
+const channelNameSpecialChars = " !#$%&()+-:;<=.>?@[]^_{}|~,"
+
+// maxChannelNameLength is the exclusive upper bound Agora places on a channel name, in bytes
+const maxChannelNameLength = 64
+
+// ValidateChannelName checks channelName against Agora's allowed character set and
+// length, so a bad name fails at token request time rather than when joining.
+func ValidateChannelName(channelName string) error {
+	if channelName == "" {
+		return fmt.Errorf("channelName is required")
+	}
+	if len(channelName) >= maxChannelNameLength {
+		return fmt.Errorf("channelName must be less than %d bytes, got %d", maxChannelNameLength, len(channelName))
+	}
+
+	var invalid []string
+	for _, char := range channelName {
+		allowed := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') ||
+			strings.ContainsRune(channelNameSpecialChars, char)
+		quoted := strconv.QuoteRune(char)
+		if !allowed && !containsString(invalid, quoted) {
+			invalid = append(invalid, quoted)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("channelName contains characters Agora does not allow: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 func parseRtmParams(c *gin.Context) (uidStr string, expireTimestamp uint32, err error) {
 	// get param values
-	uidStr = c.Param("uid")
-	expireTime := c.DefaultQuery("expiry", "3600")
+	if uidStr, err = resolveUid(c, c.Param("uid")); err != nil {
+		return uidStr, expireTimestamp, err
+	}
+	expireTime := c.DefaultQuery("expiry", strconv.FormatUint(uint64(defaultExpireTime), 10))
 
 	expireTime64, parseErr := strconv.ParseUint(expireTime, 10, 64)
 	if parseErr != nil {
@@ -208,29 +618,238 @@ func parseRtmParams(c *gin.Context) (uidStr string, expireTimestamp uint32, err
 	return uidStr, expireTimestamp, err
 }
 
-func generateRtcToken(channelName, uidStr, tokentype string, role rtctokenbuilder.Role, expireTimestamp uint32) (rtcToken string, err error) {
+// errUidRequired rejects request bodies without a uid when TRUST_JWT_UID isn't set
+var errUidRequired = errors.New("uid is required")
+
+// resolveUid returns the uid a token should be issued for. With TRUST_JWT_UID set the
+// client supplied uid is ignored in favour of the authenticated sub claim, so clients
+// can't mint tokens impersonating other users.
+func resolveUid(c *gin.Context, clientUid string) (string, error) {
+	if !trustJWTUID {
+		return clientUid, nil
+	}
+	userID := c.GetString(userIDKey)
+	if userID == "" {
+		return "", fmt.Errorf("authenticated token has no sub claim to use as uid")
+	}
+	return userID, nil
+}
+
+// renewRequest is the body accepted by the token renewal endpoint. uid is required
+// unless TRUST_JWT_UID replaces it with the sub claim.
+type renewRequest struct {
+	Token       string `json:"token" binding:"required"`
+	ChannelName string `json:"channelName" binding:"required"`
+	Uid         string `json:"uid"`
+	Expiry      uint32 `json:"expiry"`
+}
+
+// bindJSON decodes the request body into obj. With STRICT_JSON set, unknown fields
+// are rejected so client typos surface as errors instead of silently empty values.
+func bindJSON(c *gin.Context, obj interface{}) error {
+	if !strictJSON {
+		return c.ShouldBindJSON(obj)
+	}
+	if c.Request.Body == nil {
+		return fmt.Errorf("request body is empty")
+	}
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		return err
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
+
+// useJSONFieldNames makes binding validation errors name fields the way clients send them
+func useJSONFieldNames() {
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			return strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		})
+	}
+}
 
-	if tokentype == "userAccount" {
-		log.Printf("Building Token with userAccount: %s\n", uidStr)
-		rtcToken, err = rtctokenbuilder.BuildTokenWithUserAccount(appID, appCertificate, channelName, uidStr, role, expireTimestamp)
-		return rtcToken, err
+// fieldError describes why one field of a request body was rejected
+type fieldError struct {
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+}
 
-	} else if tokentype == "uid" {
-		uid64, parseErr := strconv.ParseUint(uidStr, 10, 64)
-		// check if conversion fails
-		if parseErr != nil {
-			err = fmt.Errorf("failed to parse uidStr: %s, to uint causing error: %s", uidStr, parseErr)
-			return "", err
+// bindErrorDetails turns a bindJSON error into field level reasons clients can act on
+func bindErrorDetails(err error) []fieldError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var validationErrs validator.ValidationErrors
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return []fieldError{{Reason: "request body is empty"}}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return []fieldError{{Reason: "malformed JSON: body ended unexpectedly"}}
+	case errors.As(err, &syntaxErr):
+		return []fieldError{{Reason: fmt.Sprintf("malformed JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error())}}
+	case errors.As(err, &typeErr):
+		return []fieldError{{Field: typeErr.Field, Reason: fmt.Sprintf("expected %s but got %s", typeErr.Type, typeErr.Value)}}
+	case errors.As(err, &validationErrs):
+		details := make([]fieldError, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			reason := "failed the " + fieldErr.Tag() + " check"
+			if fieldErr.Tag() == "required" {
+				reason = "is required"
+			}
+			details = append(details, fieldError{Field: fieldErr.Field(), Reason: reason})
 		}
+		return details
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for DisallowUnknownFields
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return []fieldError{{Field: field, Reason: "unknown field"}}
+	default:
+		return []fieldError{{Reason: err.Error()}}
+	}
+}
+
+func renewRtcToken(c *gin.Context) {
+	logger.Debugf("renew rtc token")
+	var req renewRequest
+	if err := bindJSON(c, &req); err != nil {
+		c.Error(err)
+		abortWithBindError(c, "Error Renewing RTC token: invalid request body", err)
+		return
+	}
+
+	if channelErr := ValidateChannelName(req.ChannelName); channelErr != nil {
+		c.Error(channelErr)
+		abortWithError(c, 400, "Error Renewing RTC token: "+channelErr.Error())
+		return
+	}
 
-		uid := uint32(uid64) // convert uid from uint64 to uint 32
-		log.Printf("Building Token with uid: %d\n", uid)
-		rtcToken, err = rtctokenbuilder.BuildTokenWithUID(appID, appCertificate, channelName, uid, role, expireTimestamp)
-		return rtcToken, err
+	uid, uidErr := resolveUid(c, req.Uid)
+	if uidErr == nil && uid == "" {
+		uidErr = errUidRequired
+	}
+	if uidErr != nil {
+		c.Error(uidErr)
+		abortWithError(c, 400, "Error Renewing RTC token: "+uidErr.Error())
+		return
+	}
+	req.Uid = uid
+
+	creds := c.MustGet(credentialsKey).(config.Credentials)
+	tokenReq, lifetime, verifyErr := verifyRtcToken(creds, req.Token, req.ChannelName, req.Uid)
+	if verifyErr != nil {
+		logger.Warnf("%s", verifyErr) // token failed to validate
+		c.Error(verifyErr)
+		abortWithError(c, 401, "Error Renewing RTC token - "+verifyErr.Error())
+		return
+	}
+
+	if req.Expiry == 0 {
+		req.Expiry = defaultExpireTime
+	}
+	// renewing never extends a token's lifetime, so capped tokens like guest tokens stay capped
+	if req.Expiry > lifetime {
+		req.Expiry = lifetime
+	}
+	expireTimestamp, expiryErr := expireTimestampIn(req.Expiry)
+	if expiryErr != nil {
+		c.Error(expiryErr)
+		abortWithError(c, 400, "Error Renewing RTC token: "+expiryErr.Error())
+		return
+	}
+
+	if !authorizeToken(c, tokenReq) {
+		return
+	}
+	tokenReq.ExpireTimestamp = expireTimestamp
+	rtcToken, tokenErr := issueToken(rtcUserAccountTokenGenerator{}, tokenReq)
+
+	if tokenErr != nil {
+		logger.Warnf("%s", tokenErr) // token failed to generate
+		c.Error(tokenErr)
+		abortWithError(c, 400, "Error Renewing RTC token - "+tokenErr.Error())
+	} else {
+		logger.Infof("RTC Token renewed")
+		c.JSON(200, gin.H{
+			"rtcToken": rtcToken,
+		})
+	}
+}
+
+// expireTimestampIn returns the timestamp expiry seconds from now, rejecting lifetimes
+// that would overflow the uint32 timestamps tokens carry
+func expireTimestampIn(expiry uint32) (uint32, error) {
+	currentTimestamp := uint32(time.Now().UTC().Unix())
+	if expiry > math.MaxUint32-currentTimestamp {
+		return 0, fmt.Errorf("expiry must be at most %d seconds", math.MaxUint32-currentTimestamp)
+	}
+	return currentTimestamp + expiry, nil
+}
+
+// renewGracePeriod is how many seconds after expiring a token can still be renewed,
+// so clients renewing right at expiry or with a skewed clock aren't locked out
+const renewGracePeriod = 5 * 60
+
+// verifyRtcToken checks that rtcToken was signed with our certificate for the given
+// channel and uid, and hasn't been expired for longer than renewGracePeriod. The 006
+// token format only carries CRCs of the channel name and uid, so the caller has to
+// supply them; the role and data stream privilege are recovered from the token's
+// privileges. The returned request has no expiration set; lifetime is how many seconds
+// the token was issued for, or math.MaxUint32 when it never expires.
+func verifyRtcToken(creds config.Credentials, rtcToken, channelName, uid string) (req TokenRequest, lifetime uint32, err error) {
+	if len(rtcToken) <= accesstoken.VERSION_LENGTH+accesstoken.APP_ID_LENGTH {
+		return req, 0, fmt.Errorf("malformed token")
+	}
+	if rtcToken[accesstoken.VERSION_LENGTH:accesstoken.VERSION_LENGTH+accesstoken.APP_ID_LENGTH] != creds.AppID {
+		return req, 0, fmt.Errorf("token was not issued for this appID")
+	}
+
+	var token accesstoken.AccessToken
+	if !token.FromString(rtcToken) {
+		return req, 0, fmt.Errorf("malformed token")
+	}
+
+	// the token builder drops uid 0 from the signature, so accept either form
+	uidStr := uid
+	if uid == "0" && crc32.ChecksumIEEE([]byte(uid)) != token.CrcUid {
+		uidStr = ""
+	}
+	if crc32.ChecksumIEEE([]byte(channelName)) != token.CrcChannelName || crc32.ChecksumIEEE([]byte(uidStr)) != token.CrcUid {
+		return req, 0, fmt.Errorf("token does not match channelName: %s and uid: %s", channelName, uid)
+	}
+
+	mac := hmac.New(sha256.New, []byte(creds.AppCertificate))
+	mac.Write([]byte(creds.AppID + channelName + uidStr))
+	mac.Write([]byte(token.MsgRawContent))
+	if !hmac.Equal(mac.Sum(nil), []byte(token.Signature)) {
+		return req, 0, fmt.Errorf("token signature is invalid")
+	}
+
+	joinExpire, canJoin := token.Message[accesstoken.KJoinChannel]
+	if !canJoin {
+		return req, 0, fmt.Errorf("token has no join channel privilege")
+	}
+	// an expiration of 0 never expires
+	if joinExpire != 0 && uint64(joinExpire)+renewGracePeriod < uint64(time.Now().UTC().Unix()) {
+		return req, 0, fmt.Errorf("token expired at %s", time.Unix(int64(joinExpire), 0).UTC().Format(time.RFC3339))
+	}
+
+	// the token builder stamps Ts 24 hours after the token was built
+	lifetime = math.MaxUint32
+	if joinExpire != 0 {
+		lifetime = 0
+		if issuedFor := int64(joinExpire) - (int64(token.Ts) - 24*3600); issuedFor > 0 {
+			lifetime = uint32(issuedFor)
+		}
+	}
 
+	req = TokenRequest{Credentials: creds, ChannelName: channelName, UidStr: uidStr}
+	if _, canPublish := token.Message[accesstoken.KPublishAudioStream]; canPublish {
+		req.Role = rtctokenbuilder.RolePublisher
 	} else {
-		err = fmt.Errorf("failed to generate RTC token for Unknown Tokentype: %s", tokentype)
-		log.Println(err)
-		return "", err
+		req.Role = rtctokenbuilder.RoleSubscriber
 	}
+	_, req.CanPublishDataStream = token.Message[accesstoken.KPublishDataStream]
+	return req, lifetime, nil
 }
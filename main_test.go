@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/go-tokenbuilder/accesstoken"
+	"github.com/AgoraIO-Community/go-tokenbuilder/rtctokenbuilder"
+	"github.com/digitallysavvy/agora-token-server/config"
+	"github.com/gin-gonic/gin"
+)
+
+var testCredentials = config.Credentials{
+	AppID:          "970ca35de60c44645bbae8a215061b33",
+	AppCertificate: "5cfd2fd1755d40ecb72977518be15d3b",
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	defaultExpireTime = config.DefaultTokenExpireSeconds
+	guestMaxExpireTime = config.DefaultGuestMaxExpireSeconds
+	os.Exit(m.Run())
+}
+
+// newTestRouter serves handlers at path with testCredentials selected, the way
+// appCredentials would for a single tenant
+func newTestRouter(method, path string, handlers ...gin.HandlerFunc) *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(credentialsKey, testCredentials)
+	})
+	router.Handle(method, path, handlers...)
+	return router
+}
+
+// serve sends a request to router and decodes the JSON response body into response
+func serve(t *testing.T, router http.Handler, method, target, body string, response interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if response != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s %s responded with invalid JSON %q: %s", method, target, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+// decodeToken parses a 006 token, failing the test when it can't be decoded
+func decodeToken(t *testing.T, rtcToken string) accesstoken.AccessToken {
+	t.Helper()
+	var token accesstoken.AccessToken
+	if !token.FromString(rtcToken) {
+		t.Fatalf("token %q can't be decoded", rtcToken)
+	}
+	return token
+}
+
+// testAuthorizer records the channels and uids it's asked about, rejecting the channels in deny
+type testAuthorizer struct {
+	deny  map[string]bool
+	calls chan string
+}
+
+func (authorizer testAuthorizer) Authorize(ctx context.Context, channel, uid string, role rtctokenbuilder.Role) error {
+	if authorizer.calls != nil {
+		authorizer.calls <- channel + "/" + uid
+	}
+	if authorizer.deny[channel] {
+		return errors.New("channel is closed")
+	}
+	return nil
+}
+
+// useAuthorizer swaps in authorizer for the rest of the test
+func useAuthorizer(t *testing.T, testAuthorizer Authorizer) {
+	previous := authorizer
+	authorizer = testAuthorizer
+	t.Cleanup(func() { authorizer = previous })
+}
+
+func TestBuildRtcTokenDataStreamPrivilege(t *testing.T) {
+	for _, canPublishDataStream := range []bool{true, false} {
+		req := TokenRequest{
+			Credentials:          testCredentials,
+			ChannelName:          "room",
+			UidStr:               "42",
+			Role:                 rtctokenbuilder.RolePublisher,
+			ExpireTimestamp:      uint32(time.Now().UTC().Unix()) + 3600,
+			CanPublishDataStream: canPublishDataStream,
+		}
+		rtcToken, err := buildRtcToken(req, req.UidStr)
+		if err != nil {
+			t.Fatalf("buildRtcToken(CanPublishDataStream: %t) failed: %s", canPublishDataStream, err)
+		}
+
+		var token accesstoken.AccessToken
+		if !token.FromString(rtcToken) {
+			t.Fatalf("buildRtcToken(CanPublishDataStream: %t) built an undecodable token", canPublishDataStream)
+		}
+		if _, hasDataStream := token.Message[accesstoken.KPublishDataStream]; hasDataStream != canPublishDataStream {
+			t.Errorf("buildRtcToken(CanPublishDataStream: %t) data stream privilege present = %t", canPublishDataStream, hasDataStream)
+		}
+		for _, privilege := range []accesstoken.Privileges{accesstoken.KJoinChannel, accesstoken.KPublishAudioStream, accesstoken.KPublishVideoStream} {
+			if _, present := token.Message[uint16(privilege)]; !present {
+				t.Errorf("buildRtcToken(CanPublishDataStream: %t) is missing privilege %d", canPublishDataStream, privilege)
+			}
+		}
+	}
+}
+
+// tamperSignature flips a byte of the token's signature
+func tamperSignature(t *testing.T, rtcToken string) string {
+	t.Helper()
+	prefix := accesstoken.VERSION_LENGTH + accesstoken.APP_ID_LENGTH
+	content, err := base64.StdEncoding.DecodeString(rtcToken[prefix:])
+	if err != nil {
+		t.Fatalf("token %q content isn't base64: %s", rtcToken, err)
+	}
+	// the content starts with the length prefixed signature
+	content[2] ^= 0xff
+	return rtcToken[:prefix] + base64.StdEncoding.EncodeToString(content)
+}
+
+func TestVerifyRtcToken(t *testing.T) {
+	now := uint32(time.Now().UTC().Unix())
+	build := func(creds config.Credentials, generator TokenGenerator, channelName, uid string, role rtctokenbuilder.Role, expireTimestamp uint32) string {
+		rtcToken, err := generator.Generate(TokenRequest{
+			Credentials:          creds,
+			ChannelName:          channelName,
+			UidStr:               uid,
+			Role:                 role,
+			ExpireTimestamp:      expireTimestamp,
+			CanPublishDataStream: true,
+		})
+		if err != nil {
+			t.Fatalf("building test token failed: %s", err)
+		}
+		return rtcToken
+	}
+	publisherToken := build(testCredentials, rtcUserAccountTokenGenerator{}, "room", "alice", rtctokenbuilder.RolePublisher, now+3600)
+	otherApp := config.Credentials{AppID: "0123456789abcdef0123456789abcdef", AppCertificate: testCredentials.AppCertificate}
+	otherCertificate := config.Credentials{AppID: testCredentials.AppID, AppCertificate: "0123456789abcdef0123456789abcdef"}
+
+	tests := []struct {
+		name        string
+		token       string
+		channelName string
+		uid         string
+		wantErr     string
+		wantRole    rtctokenbuilder.Role
+	}{
+		{name: "publisher round trip", token: publisherToken, channelName: "room", uid: "alice", wantRole: rtctokenbuilder.RolePublisher},
+		{name: "subscriber round trip", token: build(testCredentials, rtcUidTokenGenerator{}, "room", "42", rtctokenbuilder.RoleSubscriber, now+3600),
+			channelName: "room", uid: "42", wantRole: rtctokenbuilder.RoleSubscriber},
+		{name: "tampered signature", token: tamperSignature(t, publisherToken), channelName: "room", uid: "alice", wantErr: "signature is invalid"},
+		{name: "other appID", token: build(otherApp, rtcUserAccountTokenGenerator{}, "room", "alice", rtctokenbuilder.RolePublisher, now+3600),
+			channelName: "room", uid: "alice", wantErr: "not issued for this appID"},
+		{name: "other certificate", token: build(otherCertificate, rtcUserAccountTokenGenerator{}, "room", "alice", rtctokenbuilder.RolePublisher, now+3600),
+			channelName: "room", uid: "alice", wantErr: "signature is invalid"},
+		{name: "wrong channel", token: publisherToken, channelName: "other", uid: "alice", wantErr: "does not match"},
+		{name: "wrong uid", token: publisherToken, channelName: "room", uid: "bob", wantErr: "does not match"},
+		{name: "uid 0 left out of the token", token: build(testCredentials, rtcUidTokenGenerator{}, "room", "0", rtctokenbuilder.RolePublisher, now+3600),
+			channelName: "room", uid: "0", wantRole: rtctokenbuilder.RolePublisher},
+		{name: "uid 0 signed as a string", token: build(testCredentials, rtcUserAccountTokenGenerator{}, "room", "0", rtctokenbuilder.RolePublisher, now+3600),
+			channelName: "room", uid: "0", wantRole: rtctokenbuilder.RolePublisher},
+		{name: "expired within the grace period", token: build(testCredentials, rtcUserAccountTokenGenerator{}, "room", "alice", rtctokenbuilder.RolePublisher, now-renewGracePeriod+60),
+			channelName: "room", uid: "alice", wantRole: rtctokenbuilder.RolePublisher},
+		{name: "expired past the grace period", token: build(testCredentials, rtcUserAccountTokenGenerator{}, "room", "alice", rtctokenbuilder.RolePublisher, now-renewGracePeriod-60),
+			channelName: "room", uid: "alice", wantErr: "token expired"},
+		{name: "malformed token", token: "006" + testCredentials.AppID + "not a token", channelName: "room", uid: "alice", wantErr: "malformed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _, err := verifyRtcToken(testCredentials, test.token, test.channelName, test.uid)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("verifyRtcToken error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyRtcToken failed: %s", err)
+			}
+			if req.Role != test.wantRole || req.ChannelName != test.channelName {
+				t.Errorf("verifyRtcToken = %+v, want role %d in %s", req, test.wantRole, test.channelName)
+			}
+			if req.Role == rtctokenbuilder.RolePublisher && !req.CanPublishDataStream {
+				t.Errorf("verifyRtcToken lost the data stream privilege")
+			}
+		})
+	}
+}
+
+func TestVerifyRtcTokenLifetime(t *testing.T) {
+	expiry := uint32(300)
+	rtcToken, _ := rtcUserAccountTokenGenerator{}.Generate(TokenRequest{
+		Credentials:     testCredentials,
+		ChannelName:     "room",
+		UidStr:          "alice",
+		ExpireTimestamp: uint32(time.Now().UTC().Unix()) + expiry,
+	})
+	_, lifetime, err := verifyRtcToken(testCredentials, rtcToken, "room", "alice")
+	if err != nil {
+		t.Fatalf("verifyRtcToken failed: %s", err)
+	}
+	// building the token and reading the clock can straddle a second
+	if lifetime < expiry || lifetime > expiry+1 {
+		t.Errorf("verifyRtcToken lifetime = %d, want %d", lifetime, expiry)
+	}
+}
+
+func TestRenewGuestTokenKeepsLifetimeCap(t *testing.T) {
+	router := newTestRouter("GET", "/rtc/:channelName/:role/:tokentype/:uid/", getRtcToken)
+	router.POST("/token/renew", renewRtcToken)
+
+	var issued struct {
+		RtcToken string `json:"rtcToken"`
+	}
+	if code := serve(t, router, "GET", "/rtc/room/subscriber/userAccount/guest/?guest=true", "", &issued); code != 200 {
+		t.Fatalf("guest token request responded %d", code)
+	}
+
+	var renewed struct {
+		RtcToken string    `json:"rtcToken"`
+		Error    *apiError `json:"error"`
+	}
+	body := `{"token":"` + issued.RtcToken + `","channelName":"room","uid":"guest","expiry":31536000}`
+	if code := serve(t, router, "POST", "/token/renew", body, &renewed); code != 200 {
+		t.Fatalf("renew responded %d: %+v", code, renewed.Error)
+	}
+	joinExpire := decodeToken(t, renewed.RtcToken).Message[accesstoken.KJoinChannel]
+	if maxExpire := uint32(time.Now().UTC().Unix()) + guestMaxExpireTime; joinExpire > maxExpire {
+		t.Errorf("renewed guest token expires at %d, past the guest cap at %d", joinExpire, maxExpire)
+	}
+}
+
+func TestHealthFailureUsesErrorEnvelope(t *testing.T) {
+	previousDefault, previousTenants := defaultCredentials, tenantCredentials
+	defer func() { defaultCredentials, tenantCredentials = previousDefault, previousTenants }()
+	defaultCredentials = &testCredentials
+	tenantCredentials = map[string]config.Credentials{"broken": {AppID: "not-hex", AppCertificate: testCredentials.AppCertificate}}
+
+	router := newTestRouter("GET", "/healthz", getHealth)
+	var response struct {
+		Error *apiError `json:"error"`
+	}
+	code := serve(t, router, "GET", "/healthz", "", &response)
+	if code != 503 || response.Error == nil || response.Error.Code != 503 || strings.Contains(response.Error.Message, "broken") {
+		t.Errorf("failing health check responded %d: %+v, want a 503 error envelope without tenant names", code, response.Error)
+	}
+}
+
+// failingReader returns its data, then err instead of io.EOF, like a client that disconnects
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	var handled string
+	router := newTestRouter("POST", "/echo", MaxBodyBytes(8), func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		handled = string(body)
+		c.Status(204)
+	})
+
+	tests := []struct {
+		body     io.Reader
+		wantCode int
+	}{
+		{strings.NewReader("12345678"), 204},
+		{strings.NewReader("123456789"), 413},
+		{&failingReader{data: []byte("1234"), err: errors.New("connection reset")}, 400},
+	}
+	for _, test := range tests {
+		handled = ""
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/echo", test.body))
+		if recorder.Code != test.wantCode {
+			t.Errorf("body %T responded %d, want %d: %s", test.body, recorder.Code, test.wantCode, recorder.Body)
+			continue
+		}
+		if test.wantCode == 204 && handled != "12345678" {
+			t.Errorf("handler read %q, want the whole body", handled)
+		}
+		if test.wantCode != 204 {
+			var response struct {
+				Error *apiError `json:"error"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Error == nil || response.Error.Code != test.wantCode || handled != "" {
+				t.Errorf("rejected body responded %s, want an error envelope before the handler ran", recorder.Body)
+			}
+		}
+	}
+}
+
+func TestGuestRtcToken(t *testing.T) {
+	router := newTestRouter("GET", "/rtc/:channelName/:role/:tokentype/:uid/", getRtcToken)
+
+	var response struct {
+		RtcToken string    `json:"rtcToken"`
+		Error    *apiError `json:"error"`
+	}
+	if code := serve(t, router, "GET", "/rtc/room/subscriber/uid/42/?guest=true", "", &response); code != 200 {
+		t.Fatalf("guest token request responded %d: %+v", code, response.Error)
+	}
+	token := decodeToken(t, response.RtcToken)
+	if maxExpire := uint32(time.Now().UTC().Unix()) + guestMaxExpireTime; token.Message[accesstoken.KJoinChannel] > maxExpire {
+		t.Errorf("guest token without an expiry expires at %d, past the guest cap at %d", token.Message[accesstoken.KJoinChannel], maxExpire)
+	}
+	if _, publishes := token.Message[accesstoken.KPublishDataStream]; publishes {
+		t.Errorf("guest token can publish data streams")
+	}
+
+	for _, target := range []string{
+		"/rtc/room/publisher/uid/42/?guest=true",
+		"/rtc/room/subscriber/uid/42/?guest=true&canPublishDataStream=true",
+	} {
+		response.Error = nil
+		if code := serve(t, router, "GET", target, "", &response); code != 400 || response.Error == nil {
+			t.Errorf("%s responded %d, want a 400", target, code)
+		}
+	}
+}
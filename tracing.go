@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitallysavvy/agora-token-server/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// traceparentHeader is the W3C Trace Context header carrying the caller's trace and span
+const traceparentHeader = "traceparent"
+
+// spanKey is the gin context key holding the current request's span
+const spanKey = "span"
+
+// spanBatchSize is the most spans sent in one export request
+const spanBatchSize = 512
+
+// spanExportInterval is how long finished spans wait before they're exported
+const spanExportInterval = 5 * time.Second
+
+// span is one traced request
+type span struct {
+	TraceID string
+	SpanID  string
+	// ParentID is the caller's span id, empty when the request didn't carry a traceparent
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Method   string
+	// Route is the matched route pattern, empty when no route matched
+	Route      string
+	StatusCode int
+}
+
+// parseTraceparent reads the trace id, parent span id and sampled flag from a
+// traceparent header, reporting false when the header is missing or malformed
+func parseTraceparent(header string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	if !isLowerHex(parts[0], 2) || !isLowerHex(parts[1], 32) || !isLowerHex(parts[2], 16) || !isLowerHex(parts[3], 2) {
+		return "", "", false, false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+// isLowerHex reports whether s is n lowercase hex characters
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, char := range s {
+		if !(char >= '0' && char <= '9') && !(char >= 'a' && char <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHexID returns n random bytes hex encoded, for trace and span ids
+func randomHexID(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Tracing starts a span per request, continuing the caller's trace when the request
+// carries a traceparent header, and hands it to the exporter once the request ends.
+// Requests whose caller didn't sample its trace aren't exported.
+func Tracing(exporter *spanExporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := span{SpanID: randomHexID(8), Start: time.Now(), Method: c.Request.Method}
+		sampled := true
+		if traceID, parentID, parentSampled, ok := parseTraceparent(c.GetHeader(traceparentHeader)); ok {
+			s.TraceID, s.ParentID, sampled = traceID, parentID, parentSampled
+		} else {
+			s.TraceID = randomHexID(16)
+		}
+		c.Set(spanKey, s)
+
+		c.Next()
+
+		if !sampled {
+			return
+		}
+		s.End = time.Now()
+		s.StatusCode = c.Writer.Status()
+		// unmatched requests get no route, so raw paths don't end up in span names
+		s.Route = c.FullPath()
+		s.Name = strings.TrimSpace(s.Method + " " + s.Route)
+		exporter.add(s)
+	}
+}
+
+// spanExporter batches finished spans and sends them to an OTLP/HTTP collector as JSON
+type spanExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	spans       chan span
+}
+
+// newSpanExporter builds an exporter for the collector at endpoint, the base URL set
+// in OTEL_EXPORTER_OTLP_ENDPOINT, which spans are posted to under /v1/traces
+func newSpanExporter(endpoint, serviceName string) *spanExporter {
+	return &spanExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan span, 4*spanBatchSize),
+	}
+}
+
+// add queues a finished span, dropping it when the exporter has fallen behind rather
+// than holding up the request
+func (exporter *spanExporter) add(s span) {
+	select {
+	case exporter.spans <- s:
+	default:
+		logger.Debugf("span export queue is full, dropping span %s", s.SpanID)
+	}
+}
+
+// run exports queued spans every spanExportInterval, or sooner once a batch fills up
+func (exporter *spanExporter) run() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	batch := make([]span, 0, spanBatchSize)
+	for {
+		select {
+		case s := <-exporter.spans:
+			if batch = append(batch, s); len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := exporter.export(batch); err != nil {
+			logger.Warnf("failed to export %d spans to %s, causing error: %s", len(batch), exporter.url, err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// otlpAttribute is an OTLP key/value; numbers are sent as strings, as OTLP/JSON encodes int64s
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+// otlpSpan is a span in the OTLP/JSON encoding; trace and span ids are hex, not base64
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+// OTLP span kind and status codes
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusCodeError = 2
+)
+
+// export posts a batch of spans to the collector
+func (exporter *spanExporter) export(batch []span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              otlpSpanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: []otlpAttribute{
+				{Key: "http.method", Value: map[string]string{"stringValue": s.Method}},
+				{Key: "http.status_code", Value: map[string]string{"intValue": strconv.Itoa(s.StatusCode)}},
+			},
+		}
+		if s.Route != "" {
+			spans[i].Attributes = append(spans[i].Attributes, otlpAttribute{Key: "http.route", Value: map[string]string{"stringValue": s.Route}})
+		}
+		if s.StatusCode >= 500 {
+			spans[i].Status.Code = otlpStatusCodeError
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: map[string]string{"stringValue": exporter.serviceName}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/digitallysavvy/agora-token-server"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := exporter.client.Post(exporter.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header   string
+		traceID  string
+		parentID string
+		sampled  bool
+		ok       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false, true},
+		{"", "", "", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false, false},
+	}
+	for _, test := range tests {
+		traceID, parentID, sampled, ok := parseTraceparent(test.header)
+		if traceID != test.traceID || parentID != test.parentID || sampled != test.sampled || ok != test.ok {
+			t.Errorf("parseTraceparent(%q) = %q, %q, %v, %v, want %q, %q, %v, %v", test.header,
+				traceID, parentID, sampled, ok, test.traceID, test.parentID, test.sampled, test.ok)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := newSpanExporter("http://collector.invalid", "test")
+	// tracing is engine middleware here as in main, so unmatched paths are traced too
+	router := gin.New()
+	router.Use(Tracing(exporter), func(c *gin.Context) {
+		c.Set(credentialsKey, testCredentials)
+	})
+	router.GET("/rtm/:uid/", getRtmToken)
+
+	request := httptest.NewRequest("GET", "/rtm/42/", nil)
+	request.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	s := <-exporter.spans
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentID != "00f067aa0ba902b7" || len(s.SpanID) != 16 {
+		t.Errorf("span didn't continue the caller's trace: %+v", s)
+	}
+	if s.Name != "GET /rtm/:uid/" || s.StatusCode != 200 || s.End.Before(s.Start) {
+		t.Errorf("span = %+v, want a finished GET /rtm/:uid/ span with status 200", s)
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/rtm/42/", nil))
+	if s := <-exporter.spans; len(s.TraceID) != 32 || s.ParentID != "" {
+		t.Errorf("span without a traceparent = %+v, want a new root trace", s)
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown/42", nil))
+	if s := <-exporter.spans; s.Name != "GET" || s.Route != "" || s.StatusCode != 404 {
+		t.Errorf("span for an unmatched path = %+v, want a GET span without a route", s)
+	}
+
+	request = httptest.NewRequest("GET", "/rtm/42/", nil)
+	request.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	if len(exporter.spans) != 0 {
+		t.Errorf("exported a span the caller didn't sample")
+	}
+}
+
+func TestSpanExport(t *testing.T) {
+	var received struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("collector received invalid JSON: %s", body)
+		}
+	}))
+	defer collector.Close()
+
+	exporter := newSpanExporter(collector.URL+"/", "test")
+	err := exporter.export([]span{{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Name: "GET /healthz", StatusCode: 503}})
+	if err != nil {
+		t.Fatalf("export failed: %s", err)
+	}
+	if path != "/v1/traces" || len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("collector received %+v on %s", received, path)
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].SpanID != "00f067aa0ba902b7" || spans[0].Status.Code != otlpStatusCodeError {
+		t.Errorf("collector received spans %+v, want the 503 span with an error status", spans)
+	}
+}